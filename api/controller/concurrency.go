@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"build-machine/internal"
+	"build-machine/logging"
+	statemanager "build-machine/state_manager"
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// errBuildInProgress rejects deploys of a project stage that is being
+	// built under the reject policy.
+	errBuildInProgress = errors.New("a build of the project stage is in progress")
+	// errBuildScheduling is returned for builds that left the queue but
+	// aren't on a cluster yet.
+	errBuildScheduling = errors.New("job is being scheduled, try again")
+	// errClusterUnavailable is returned when the cluster of a build can't be reached.
+	errClusterUnavailable = errors.New("build cluster unavailable")
+)
+
+// createState records the build job_id of project for token within quota and
+// returns the builds of project that are in progress. Under the reject policy
+// the build is only recorded if there are none.
+func (d *deploymentsController) createState(job_id, token string, project statemanager.ProjectStage, policy string, quota statemanager.BuildQuota) ([]string, error) {
+	d.projectsMu.Lock()
+	defer d.projectsMu.Unlock()
+	inProgress := d.stateManager.UnfinishedBuilds(project)
+	if policy == internal.ConcurrencyReject && len(inProgress) > 0 {
+		return inProgress, errBuildInProgress
+	}
+
+	if err := d.stateManager.CreateState(job_id, token, statemanager.EngineArgo, quota); err != nil {
+		return nil, err
+	}
+	return inProgress, d.stateManager.SetProject(job_id, project)
+}
+
+// supersede stops the builds that job_id replaces. A build that can't be
+// stopped keeps running, the queue starts job_id once it is over.
+func (d *deploymentsController) supersede(ctx context.Context, job_id string, previous []string) {
+	for _, previous_id := range previous {
+		logger := logging.FromContext(ctx).With("superseded_job_id", previous_id)
+		previous_state, err := d.stateManager.GetState(previous_id)
+		if err != nil || previous_state.BuildStatus.IsTerminal() {
+			continue
+		}
+		if err := d.stopBuild(ctx, previous_id, previous_state); err != nil {
+			logger.Warn("Failed to stop superseded build", "error", err)
+			continue
+		}
+		err = d.stateManager.UpdateState(previous_id, "Superseded by "+job_id, statemanager.StatusSuperseded)
+		if err != nil {
+			logger.Warn("Failed to record superseded build", "error", err)
+			continue
+		}
+		logger.Info("Build superseded")
+	}
+}
+
+// stopBuild takes the build job_id out of the queue or stops its workflow.
+func (d *deploymentsController) stopBuild(ctx context.Context, job_id string, job_state statemanager.State) error {
+	if job_state.BuildStatus == statemanager.StatusQueued {
+		if d.buildQueue.Remove(job_id) {
+			return nil
+		}
+		// The build left the queue in the meantime
+		job_state, _ = d.stateManager.GetState(job_id)
+		if job_state.Placement.Cluster == "" {
+			return errBuildScheduling
+		}
+	}
+	argoService, err := d.clusters.Cluster(job_state.Placement.Cluster)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errClusterUnavailable, err)
+	}
+	return argoService.CancelWorkflow(ctx, job_state.Placement.Namespace, job_id)
+}
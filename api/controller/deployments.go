@@ -1,150 +1,330 @@
 package controller
 
 import (
+	"build-machine/api/types"
 	"build-machine/internal"
+	"build-machine/logging"
+	"build-machine/metrics"
+	"build-machine/queue"
 	"build-machine/service"
 	statemanager "build-machine/state_manager"
+	"build-machine/tracing"
+	"build-machine/utils"
 	"build-machine/workflows"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type DeploymentsController interface {
 	Deploy(w http.ResponseWriter, r *http.Request)
 	GetState(w http.ResponseWriter, r *http.Request)
+	ListJobs(w http.ResponseWriter, r *http.Request)
+	LegacyGetState(w http.ResponseWriter, r *http.Request)
+	GetRegions(w http.ResponseWriter, r *http.Request)
+	Cancel(w http.ResponseWriter, r *http.Request)
+	GetLogs(w http.ResponseWriter, r *http.Request)
 	HealthCheck(w http.ResponseWriter, r *http.Request)
+	Livez(w http.ResponseWriter, r *http.Request)
+	Readyz(w http.ResponseWriter, r *http.Request)
 }
 
 type deploymentsController struct {
-	argoService  *service.ArgoService
+	clusters     *service.ClusterRegistry
 	stateManager statemanager.StateManager
+	buildQueue   *queue.BuildQueue
+	// projectsMu makes checking the builds in progress of a project stage and
+	// recording a new one atomic
+	projectsMu sync.Mutex
 }
 
-func NewDeploymentsController() DeploymentsController {
-	stateManager := statemanager.NewLocalStateManager()
+func NewDeploymentsController(clusters *service.ClusterRegistry) DeploymentsController {
+	stateManager := metrics.InstrumentStateManager(statemanager.NewLocalStateManager())
+	buildQueue := queue.NewBuildQueue(stateManager)
+	go buildQueue.Run(context.Background())
 	return &deploymentsController{
-		argoService:  service.NewArgoService(),
+		clusters:     clusters,
 		stateManager: stateManager,
+		buildQueue:   buildQueue,
 	}
 }
 
-type ResGetState struct {
-	BuildEngine string
-	BuildStatus statemanager.BuildStatus
-	Timestamp   time.Time
-	Transitions []statemanager.StateTransition
+// bearerToken returns the token of the Authorization header, otherwise it
+// writes the error response.
+func bearerToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		WriteError(w, http.StatusUnauthorized, types.CodeUnauthorized, "Authorization header is required")
+		return "", false
+	}
+	// Drop the "Bearer " prefix
+	return strings.TrimPrefix(token, "Bearer "), true
 }
 
-// GetState implements DeploymentsController.
-func (d *deploymentsController) GetState(w http.ResponseWriter, r *http.Request) {
+// jobForRequest returns the job named in the path if it belongs to the
+// bearer token of the request, otherwise it writes the error response. Jobs of
+// other users are reported as not found, so job ids can't be probed.
+func (d *deploymentsController) jobForRequest(w http.ResponseWriter, r *http.Request) (string, statemanager.State, bool) {
 	job_id := r.PathValue("job_id")
 	if job_id == "" {
-		http.Error(w, "job_id is required", http.StatusBadRequest)
-		return
+		WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, "job_id is required")
+		return "", statemanager.State{}, false
 	}
-	// extract bearer token from Authorization header
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Authorization header is required", http.StatusBadRequest)
-		return
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return "", statemanager.State{}, false
 	}
-	// Drop the "Bearer " prefix
-	token = token[7:]
 
 	job_state, err := d.stateManager.GetState(job_id)
+	if errors.Is(err, statemanager.ErrJobNotFound) || (err == nil && job_state.UserToken != token) {
+		WriteError(w, http.StatusNotFound, types.CodeNotFound, "job "+job_id+" not found")
+		return "", statemanager.State{}, false
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
+		return "", statemanager.State{}, false
 	}
-	if job_state.UserToken != token {
-		http.Error(w, "job_id not found", http.StatusNotFound)
+	return job_id, job_state, true
+}
+
+// GetState implements DeploymentsController.
+func (d *deploymentsController) GetState(w http.ResponseWriter, r *http.Request) {
+	job_id, job_state, ok := d.jobForRequest(w, r)
+	if !ok {
 		return
 	}
-	res := ResGetState{
-		BuildEngine: job_state.BuildEngine,
-		BuildStatus: job_state.BuildStatus,
-		Timestamp:   job_state.Timestamp,
-		Transitions: job_state.Transitions,
-	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(res)
+	json.NewEncoder(w).Encode(d.stateResponse(job_id, job_state))
 }
 
-type ReqDeploy struct {
-	Token string          `json:"token"`
-	Type  string          `json:"type"`
-	Stage string          `json:"stage"`
-	Args  json.RawMessage `json:"args"`
-}
-
-type ResDeploy struct {
-	JobID  string `json:"jobID"`
-	Status string `json:"status"`
+func (d *deploymentsController) stateResponse(job_id string, job_state statemanager.State) types.ResGetState {
+	res := types.ResGetState{
+		BuildEngine: job_state.BuildEngine,
+		BuildStatus: job_state.BuildStatus,
+		Timestamp:   job_state.Timestamp,
+		Transitions: job_state.Transitions,
+		Cluster:     job_state.Placement.Cluster,
+		Namespace:   job_state.Placement.Namespace,
+		Archive:     job_state.Archive,
+	}
+	if job_state.BuildStatus == statemanager.StatusQueued {
+		res.QueuePosition, _ = d.buildQueue.Position(job_id)
+	}
+	return res
 }
 
 func (d *deploymentsController) Deploy(w http.ResponseWriter, r *http.Request) {
-	var body ReqDeploy
+	var body types.ReqDeploy
+	var res types.ResDeploy
+	ctx, span := tracing.Start(r.Context(), "Deploy")
+	deployType := "unknown"
+	outcome := metrics.OutcomeRejected
+	defer func() {
+		metrics.DeployRequests.WithLabelValues(deployType, outcome).Inc()
+		span.SetAttributes(
+			attribute.String("deploy.type", deployType),
+			attribute.String("deploy.outcome", outcome),
+		)
+		span.End()
+	}()
+
 	// Decode JSON body
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, err.Error())
 		return
 	}
 
 	if body.Token == "" {
-		http.Error(w, "token is required", http.StatusBadRequest)
-		return
-	}
-	if body.Type == "" {
-		http.Error(w, fmt.Sprintf("type is required, one of [%v]", workflows.AvailableDeployments), http.StatusBadRequest)
+		WriteError(w, http.StatusUnauthorized, types.CodeUnauthorized, "token is required")
 		return
 	}
 	if body.Args == nil {
-		http.Error(w, "args is required", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, "args is required")
 		return
 	}
-	workflowExecutor := workflows.GetWorkflowExecutor(body.Type, body.Token)
+	workflowExecutor := workflows.GetWorkflowExecutor(body.Type, body.Token, d.clusters)
 	if workflowExecutor == nil {
-		http.Error(w, fmt.Sprintf("type is required, one of [%v]", workflows.AvailableDeployments), http.StatusBadRequest)
+		WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidRequest, fmt.Sprintf("type is required, one of [%v]", workflows.AvailableDeployments), map[string]any{
+			"allowedTypes": workflows.AvailableDeployments,
+		})
 		return
 	}
+	deployType = body.Type
+	ctx = logging.With(ctx, "deploy_type", deployType)
+	logger := logging.FromContext(ctx)
 
 	workflowExecutor.AssignStateManager(d.stateManager)
 
-	maxConcurrentBuilds, err := strconv.ParseInt(internal.GetConfig().MaxConcurrentBuilds, 10, 64)
+	var idempotencyKey *statemanager.IdempotencyKey
+	var requestHash string
+	if key := r.Header.Get(types.IdempotencyKeyHeader); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, fmt.Sprintf("%s must be at most %d characters", types.IdempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+		requestHash, err = deployRequestHash(body)
+		if err != nil {
+			outcome = metrics.OutcomeError
+			WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
+			return
+		}
+		idempotencyKey = &statemanager.IdempotencyKey{Token: body.Token, Key: key}
+		record, claimed, err := d.stateManager.ClaimIdempotencyKey(*idempotencyKey, requestHash)
+		if err != nil {
+			outcome = metrics.OutcomeError
+			WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
+			return
+		}
+		if !claimed {
+			if replayDeploy(w, record, requestHash) {
+				outcome = metrics.OutcomeReplayed
+				logger.Info("Replayed deploy", "job_id", record.JobID)
+			}
+			return
+		}
+		// Let the client retry a request that didn't queue a build
+		defer func() {
+			if outcome != metrics.OutcomeAccepted {
+				d.stateManager.ReleaseIdempotencyKey(*idempotencyKey)
+			}
+		}()
+	}
+
+	if err := d.buildQueue.Accepts(body.Token); err != nil {
+		WriteError(w, http.StatusTooManyRequests, types.CodeLimitExceeded, err.Error())
+		return
+	}
+
+	validateCtx, validateSpan := tracing.Start(ctx, "Validate")
+	err = workflowExecutor.Validate(validateCtx, body.Args)
+	tracing.End(validateSpan, err)
 	if err != nil {
-		http.Error(w, "failed to parse MAX_CONCURRENT_BUILDS", http.StatusInternalServerError)
+		logger.Info("Rejected invalid deploy request", "error", err)
+		WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, err.Error())
 		return
 	}
-	userCurrentBuildCount := d.stateManager.GetConcurrentBuilds(body.Token)
-	if userCurrentBuildCount >= int(maxConcurrentBuilds) {
-		http.Error(w, fmt.Sprintf("user has reached the maximum concurrent builds of %d", maxConcurrentBuilds), http.StatusBadRequest)
+
+	account, tierName, tier := userForToken(ctx, body.Token)
+	ctx = logging.With(ctx, "tier", tierName)
+	logger = logging.FromContext(ctx)
+	span.SetAttributes(attribute.String("user.tier", tierName))
+	resources, err := workflows.ResolveResources(tier, body.Builder)
+	if err != nil {
+		logger.Info("Rejected invalid builder options", "error", err)
+		WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, err.Error())
 		return
 	}
+	workflowExecutor.AssignResources(resources)
 
-	if err := workflowExecutor.Validate(body.Args); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	project := workflowExecutor.Project()
+	project.Account = account
+	policy := internal.GetDeployConfig().Concurrency.PolicyFor(project.ProjectName, project.Stage)
+	span.SetAttributes(attribute.String("deploy.concurrency", policy))
+
+	job_id := workflows.NewJobID(deployType)
+	ctx = logging.With(ctx, "job_id", job_id)
+	logger = logging.FromContext(ctx)
+	span.SetAttributes(attribute.String("job.id", job_id))
+	// The daily limit applies to all the tokens of the account
+	quota := statemanager.BuildQuota{
+		Account:   account,
+		MaxBuilds: tier.MaxDailyBuilds,
+		Period:    24 * time.Hour,
+	}
+	inProgress, err := d.createState(job_id, body.Token, project, policy, quota)
+	if errors.Is(err, statemanager.ErrBuildQuotaExceeded) {
+		logger.Info("Rejected deploy over the daily build limit", "max_daily_builds", tier.MaxDailyBuilds)
+		WriteErrorDetails(w, http.StatusTooManyRequests, types.CodeLimitExceeded, fmt.Sprintf("daily build limit reached, the %s plan allows %d builds per day", tierName, tier.MaxDailyBuilds), map[string]any{
+			"tier":           tierName,
+			"maxDailyBuilds": tier.MaxDailyBuilds,
+		})
+		return
+	}
+	if errors.Is(err, errBuildInProgress) {
+		logger.Info("Rejected deploy of a project stage with a build in progress", "in_progress", inProgress)
+		WriteErrorDetails(w, http.StatusConflict, types.CodeConflict, err.Error(), map[string]any{
+			"policy": policy,
+			"jobIDs": inProgress,
+		})
 		return
 	}
-	job_id, err := workflowExecutor.Submit()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		outcome = metrics.OutcomeError
+		WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
 		return
 	}
 
-	job_state, err := d.stateManager.GetState(job_id)
+	err = workflowExecutor.Prepare(ctx, job_id)
+	if err == nil {
+		var position int
+		// The build outlives the request that submitted it
+		position, err = d.buildQueue.Enqueue(&queue.Job{
+			ID:                  job_id,
+			Token:               body.Token,
+			Workflow:            workflowExecutor,
+			Region:              project.Region,
+			MaxConcurrentBuilds: tier.MaxConcurrentBuilds,
+			Ctx:                 context.WithoutCancel(ctx),
+		})
+		res.QueuePosition = position
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		outcome = metrics.OutcomeError
+		tracing.RecordError(span, err)
+		logger.Error("Failed to queue build", "error", err)
+		// The job id is not returned, so the build must not count against the
+		// limits of the user
+		d.stateManager.DeleteState(job_id)
+		if errors.Is(err, queue.ErrQueueFull) {
+			outcome = metrics.OutcomeRejected
+			WriteError(w, http.StatusTooManyRequests, types.CodeLimitExceeded, err.Error())
+			return
+		}
+		if errors.Is(err, utils.ErrArchiveTooLarge) {
+			outcome = metrics.OutcomeRejected
+			WriteError(w, http.StatusRequestEntityTooLarge, types.CodeArchiveTooLarge, err.Error())
+			return
+		}
+		WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
 		return
 	}
-	res := ResDeploy{
-		JobID:  job_id,
-		Status: string(job_state.BuildStatus),
+	logger.Info("Build queued", "queue_position", res.QueuePosition)
+	if policy == internal.ConcurrencySupersede {
+		// Only once the new build is queued, so a failed deploy doesn't
+		// stop the previous one
+		d.supersede(ctx, job_id, inProgress)
+	}
+
+	outcome = metrics.OutcomeAccepted
+	res.JobID = job_id
+	res.Status = string(statemanager.StatusQueued)
+	if job_state, err := d.stateManager.GetState(job_id); err == nil && job_state.BuildStatus != statemanager.StatusQueued {
+		// Dispatched right away
+		res.Status = string(job_state.BuildStatus)
+		res.QueuePosition = 0
+	}
+	if idempotencyKey != nil {
+		err = d.stateManager.CompleteIdempotencyKey(*idempotencyKey, statemanager.IdempotencyRecord{
+			RequestHash:   requestHash,
+			JobID:         res.JobID,
+			Status:        res.Status,
+			QueuePosition: res.QueuePosition,
+		})
+		if err != nil {
+			logger.Warn("Failed to store the idempotency key", "error", err)
+			d.stateManager.ReleaseIdempotencyKey(*idempotencyKey)
+		}
 	}
 
 	w.Header().Add("Content-Type", "application/json")
@@ -152,7 +332,34 @@ func (d *deploymentsController) Deploy(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
-func (d *deploymentsController) HealthCheck(w http.ResponseWriter, r *http.Request) {
+// userForToken returns the account of the user owning token and the tier of
+// their plan. Builds aren't blocked by the backend, if the user can't be
+// fetched the token stands for the account and the default tier applies.
+func userForToken(ctx context.Context, token string) (string, string, internal.TierConfig) {
+	user, err := utils.GetUser(ctx, token)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Failed to get user, using the default tier", "error", err)
+	}
+	account := user.ID
+	if account == "" {
+		account = token
+	}
+	tierName, tier := internal.GetDeployConfig().Tier(user.SubscriptionPlan)
+	return account, tierName, tier
+}
+
+// GetRegions implements DeploymentsController.
+func (d *deploymentsController) GetRegions(w http.ResponseWriter, r *http.Request) {
+	res := types.ResGetRegions{
+		Regions: internal.GetDeployConfig().RegionNames(),
+	}
+
+	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	json.NewEncoder(w).Encode(res)
+}
+
+// HealthCheck is kept for existing probes, it behaves like Livez.
+func (d *deploymentsController) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	d.Livez(w, r)
 }
@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"build-machine/api/types"
+	"encoding/json"
+	"net/http"
+)
+
+// WriteError writes a types.ErrorResponse with the status code.
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	WriteErrorDetails(w, status, code, message, nil)
+}
+
+// WriteErrorDetails writes a types.ErrorResponse with machine readable details.
+func WriteErrorDetails(w http.ResponseWriter, status int, code, message string, details any) {
+	res := types.ErrorResponse{
+		Code:    code,
+		Message: message,
+		Details: details,
+		// Set by the RequestID middleware before the handlers run
+		RequestID: w.Header().Get("X-Request-Id"),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"build-machine/internal"
+	"build-machine/workflows"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const readinessTimeout = 5 * time.Second
+
+type CheckResult struct {
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ResReadiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Livez implements DeploymentsController. It only reports that the process
+// is serving requests.
+func (d *deploymentsController) Livez(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// Readyz implements DeploymentsController. It reports whether the
+// dependencies needed to accept builds are reachable.
+func (d *deploymentsController) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"stateStore": d.stateManager.Ping,
+		"backend":    checkBackend,
+	}
+	// Builds are scheduled around unhealthy clusters, so one usable cluster
+	// is enough to be ready
+	clusterChecks := make(map[string]bool)
+	for _, name := range d.clusters.Names() {
+		clusterChecks["cluster:"+name] = true
+		checks["cluster:"+name] = func(ctx context.Context) error {
+			argoService, err := d.clusters.Cluster(name)
+			if err != nil {
+				return err
+			}
+			if err := argoService.Ping(ctx); err != nil {
+				return err
+			}
+			return argoService.CheckWorkflowTemplates(ctx, workflows.WorkflowTemplates())
+		}
+	}
+	clustersReady := false
+
+	res := ResReadiness{
+		Status: "ok",
+		Checks: make(map[string]CheckResult),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			result := CheckResult{
+				Status:   "ok",
+				Duration: time.Since(start).String(),
+			}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[name] = result
+			switch {
+			case clusterChecks[name]:
+				clustersReady = clustersReady || err == nil
+			case err != nil:
+				res.Status = "fail"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	if !clustersReady {
+		res.Status = "fail"
+	}
+
+	statusCode := http.StatusOK
+	if res.Status != "ok" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(res)
+}
+
+// checkBackend checks that the genezio backend answers requests. Any response
+// that is not a server error counts as reachable.
+func checkBackend(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, internal.GetConfig().BackendURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("backend responded with %s", res.Status)
+	}
+	return nil
+}
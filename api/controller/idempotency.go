@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"build-machine/api/types"
+	statemanager "build-machine/state_manager"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// deployRequestHash fingerprints a deploy request, so a key can't be reused
+// for a different one.
+func deployRequestHash(body types.ReqDeploy) (string, error) {
+	// Marshalling compacts Args, so whitespace doesn't change the hash
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// replayDeploy answers a deploy that reused a claimed key with the response of
+// the first request. It returns false if the request can't be replayed.
+func replayDeploy(w http.ResponseWriter, record statemanager.IdempotencyRecord, requestHash string) bool {
+	if record.RequestHash != requestHash {
+		WriteError(w, http.StatusConflict, types.CodeConflict, fmt.Sprintf("%s was already used for a different request", types.IdempotencyKeyHeader))
+		return false
+	}
+	if record.JobID == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(1))
+		WriteError(w, http.StatusConflict, types.CodeConflict, fmt.Sprintf("a request with the same %s is in progress", types.IdempotencyKeyHeader))
+		return false
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set(types.IdempotentReplayedHeader, "true")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(types.ResDeploy{
+		JobID:         record.JobID,
+		Status:        record.Status,
+		QueuePosition: record.QueuePosition,
+	})
+	return true
+}
@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"build-machine/api/types"
+	"build-machine/logging"
+	"build-machine/service"
+	statemanager "build-machine/state_manager"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+)
+
+// ListJobs implements DeploymentsController. It returns the latest builds of
+// the user, newest first, at most ?limit= of them.
+func (d *deploymentsController) ListJobs(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultJobsLimit
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxJobsLimit {
+			WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxJobsLimit))
+			return
+		}
+	}
+
+	states, err := d.stateManager.ListStates(token)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
+		return
+	}
+	res := types.ResListJobs{
+		Jobs: make([]types.ResJob, 0, len(states)),
+	}
+	for job_id, job_state := range states {
+		res.Jobs = append(res.Jobs, types.ResJob{
+			JobID:       job_id,
+			BuildEngine: job_state.BuildEngine,
+			BuildStatus: job_state.BuildStatus,
+			CreatedAt:   job_state.CreatedAt,
+			Timestamp:   job_state.Timestamp,
+		})
+	}
+	slices.SortFunc(res.Jobs, func(a, b types.ResJob) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	if len(res.Jobs) > limit {
+		res.Jobs = res.Jobs[:limit]
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// Cancel implements DeploymentsController. The workflow is stopped on the
+// cluster the build was scheduled on.
+func (d *deploymentsController) Cancel(w http.ResponseWriter, r *http.Request) {
+	job_id, job_state, ok := d.jobForRequest(w, r)
+	if !ok {
+		return
+	}
+	if job_state.BuildStatus.IsTerminal() {
+		WriteError(w, http.StatusConflict, types.CodeConflict, "job has already finished")
+		return
+	}
+
+	ctx := logging.With(r.Context(), "job_id", job_id, "cluster", job_state.Placement.Cluster)
+	err := d.stopBuild(ctx, job_id, job_state)
+	switch {
+	case errors.Is(err, errBuildScheduling):
+		WriteError(w, http.StatusConflict, types.CodeConflict, err.Error())
+		return
+	case errors.Is(err, errClusterUnavailable):
+		WriteError(w, http.StatusServiceUnavailable, types.CodeUnavailable, err.Error())
+		return
+	case err != nil:
+		logging.FromContext(ctx).Error("Failed to cancel build", "error", err)
+		WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
+		return
+	}
+	d.cancelled(ctx, w, job_id)
+}
+
+// cancelled records the cancellation of job_id and writes the response.
+func (d *deploymentsController) cancelled(ctx context.Context, w http.ResponseWriter, job_id string) {
+	err := d.stateManager.UpdateState(job_id, "Cancelled by user", statemanager.StatusCancelled)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
+		return
+	}
+	logging.FromContext(ctx).Info("Build cancelled")
+
+	res := types.ResDeploy{
+		JobID:  job_id,
+		Status: string(statemanager.StatusCancelled),
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// GetLogs implements DeploymentsController. With ?follow=true the logs are
+// streamed until the build exits.
+func (d *deploymentsController) GetLogs(w http.ResponseWriter, r *http.Request) {
+	job_id, job_state, ok := d.jobForRequest(w, r)
+	if !ok {
+		return
+	}
+	if job_state.Placement.Cluster == "" {
+		WriteError(w, http.StatusConflict, types.CodeConflict, "job has not started yet")
+		return
+	}
+
+	argoService, err := d.clusters.Cluster(job_state.Placement.Cluster)
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, types.CodeUnavailable, err.Error())
+		return
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+	logs, err := argoService.StreamLogs(r.Context(), job_state.Placement.Namespace, job_id, follow)
+	if errors.Is(err, service.ErrPodNotFound) || apierrors.IsNotFound(err) {
+		WriteError(w, http.StatusNotFound, types.CodeNotFound, "logs of job "+job_id+" are not available anymore")
+		return
+	}
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, types.CodeInternal, err.Error())
+		return
+	}
+	defer logs.Close()
+
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(flushWriter{w}, logs)
+}
+
+// flushWriter sends every write to the client right away.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
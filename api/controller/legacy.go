@@ -0,0 +1,62 @@
+package controller
+
+import (
+	statemanager "build-machine/state_manager"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// legacyResGetState is types.ResGetState with the field names of the unversioned
+// /state route, which predates the JSON tags.
+type legacyResGetState struct {
+	BuildEngine   string
+	BuildStatus   statemanager.BuildStatus
+	Timestamp     time.Time
+	Transitions   []legacyStateTransition
+	QueuePosition int `json:",omitempty"`
+	Cluster       string
+	Namespace     string
+	Archive       *legacyArchiveInfo
+}
+
+type legacyStateTransition struct {
+	From           statemanager.BuildStatus
+	To             statemanager.BuildStatus
+	TransitionTime time.Time
+	Reason         string
+}
+
+type legacyArchiveInfo struct {
+	Size   int64
+	SHA256 string
+}
+
+// LegacyGetState implements DeploymentsController.
+func (d *deploymentsController) LegacyGetState(w http.ResponseWriter, r *http.Request) {
+	job_id, job_state, ok := d.jobForRequest(w, r)
+	if !ok {
+		return
+	}
+	state := d.stateResponse(job_id, job_state)
+	res := legacyResGetState{
+		BuildEngine:   state.BuildEngine,
+		BuildStatus:   state.BuildStatus,
+		Timestamp:     state.Timestamp,
+		Transitions:   make([]legacyStateTransition, 0, len(state.Transitions)),
+		QueuePosition: state.QueuePosition,
+		Cluster:       state.Cluster,
+		Namespace:     state.Namespace,
+	}
+	for _, transition := range state.Transitions {
+		res.Transitions = append(res.Transitions, legacyStateTransition(transition))
+	}
+	if state.Archive != nil {
+		archive := legacyArchiveInfo(*state.Archive)
+		res.Archive = &archive
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
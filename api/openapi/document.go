@@ -0,0 +1,277 @@
+package openapi
+
+import (
+	"build-machine/api/types"
+	statemanager "build-machine/state_manager"
+	"build-machine/workflows"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const Version = "1.0.0"
+
+// Document is an OpenAPI 3 document.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// PathItem maps lower case HTTP methods to their operation.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+var (
+	spec     *Document
+	specOnce sync.Once
+)
+
+// Spec returns the document of the /v1 API, generated from the request and
+// response types of the controller.
+func Spec() *Document {
+	specOnce.Do(func() {
+		spec = newDocument()
+	})
+	return spec
+}
+
+// Handler serves the document.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Spec())
+}
+
+func newDocument() *Document {
+	statuses := make([]any, 0, len(statemanager.BuildStatuses))
+	for _, status := range statemanager.BuildStatuses {
+		statuses = append(statuses, string(status))
+	}
+	g := &generator{
+		components: make(map[string]*Schema),
+		enums: map[reflect.Type][]any{
+			reflect.TypeOf(statemanager.BuildStatus("")): statuses,
+		},
+	}
+
+	g.component(reflect.TypeOf(types.ReqDeploy{}))
+	addDeployVariants(g)
+	resDeploy := g.component(reflect.TypeOf(types.ResDeploy{}))
+	resGetState := g.component(reflect.TypeOf(types.ResGetState{}))
+	resGetRegions := g.component(reflect.TypeOf(types.ResGetRegions{}))
+	resListJobs := g.component(reflect.TypeOf(types.ResListJobs{}))
+	g.component(reflect.TypeOf(types.ErrorResponse{}))
+
+	jobID := Parameter{
+		Name:     "job_id",
+		In:       "path",
+		Required: true,
+		Schema:   &Schema{Type: "string"},
+	}
+	bearer := []map[string][]string{{"bearerAuth": {}}}
+
+	return &Document{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:       "genezio build machine",
+			Description: "Builds and deploys genezio projects from git repositories or uploaded code.",
+			Version:     Version,
+		},
+		Paths: map[string]PathItem{
+			"/v1/jobs": {
+				"get": {
+					OperationID: "listJobs",
+					Summary:     "List the latest builds of the user, newest first",
+					Parameters: []Parameter{{
+						Name:        "limit",
+						In:          "query",
+						Description: "Maximum number of builds returned, 50 by default",
+						Schema:      &Schema{Type: "integer", Format: "int32"},
+					}},
+					Responses: responses(http.StatusOK, "The builds", resListJobs,
+						http.StatusBadRequest, http.StatusUnauthorized, http.StatusTooManyRequests),
+					Security: bearer,
+				},
+				"post": {
+					OperationID: "deploy",
+					Summary:     "Queue a build",
+					Parameters: []Parameter{{
+						Name:        types.IdempotencyKeyHeader,
+						In:          "header",
+						Description: "Up to 255 characters, repeats of a request with the same key in the next 24 hours return the build queued by the first one",
+						Schema:      &Schema{Type: "string"},
+					}},
+					RequestBody: &RequestBody{
+						Required: true,
+						Content:  jsonContent(ref("ReqDeploy")),
+					},
+					Responses: responses(http.StatusCreated, "The build is queued", resDeploy,
+						http.StatusBadRequest, http.StatusUnauthorized, http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInternalServerError),
+				},
+			},
+			"/v1/jobs/{job_id}": {
+				"get": {
+					OperationID: "getState",
+					Summary:     "Get the state of a build",
+					Parameters:  []Parameter{jobID},
+					Responses: responses(http.StatusOK, "The state of the build", resGetState,
+						http.StatusUnauthorized, http.StatusNotFound, http.StatusTooManyRequests),
+					Security: bearer,
+				},
+			},
+			"/v1/jobs/{job_id}/cancel": {
+				"post": {
+					OperationID: "cancel",
+					Summary:     "Cancel a build",
+					Parameters:  []Parameter{jobID},
+					Responses: responses(http.StatusOK, "The build is cancelled", resDeploy,
+						http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict),
+					Security: bearer,
+				},
+			},
+			"/v1/jobs/{job_id}/logs": {
+				"get": {
+					OperationID: "getLogs",
+					Summary:     "Get the output of the builder",
+					Parameters: []Parameter{jobID, {
+						Name:        "follow",
+						In:          "query",
+						Description: "Stream the logs until the build exits",
+						Schema:      &Schema{Type: "boolean"},
+					}},
+					Responses: withErrors(map[string]Response{
+						"200": {
+							Description: "The logs of the build",
+							Content: map[string]MediaType{
+								"text/plain": {Schema: &Schema{Type: "string"}},
+							},
+						},
+					}, http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict),
+					Security: bearer,
+				},
+			},
+			"/v1/regions": {
+				"get": {
+					OperationID: "getRegions",
+					Summary:     "List the regions builds can deploy to",
+					Responses:   responses(http.StatusOK, "The regions", resGetRegions),
+				},
+			},
+		},
+		Components: Components{
+			Schemas: g.components,
+			SecuritySchemes: map[string]SecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer"},
+			},
+		},
+	}
+}
+
+// addDeployVariants turns ReqDeploy into one schema per deploy type, picked
+// by the type field, with the args of the deploy type.
+func addDeployVariants(g *generator) {
+	base := g.components["ReqDeploy"]
+	variants := &Schema{
+		Discriminator: &Discriminator{
+			PropertyName: "type",
+			Mapping:      make(map[string]string),
+		},
+	}
+	for _, deployType := range workflows.AvailableDeployments {
+		args, ok := types.DeploymentArgs[deployType]
+		if !ok {
+			continue
+		}
+		variant := *base
+		variant.Properties = make(map[string]*Schema)
+		for name, property := range base.Properties {
+			variant.Properties[name] = property
+		}
+		variant.Properties["type"] = &Schema{Type: "string", Enum: []any{deployType}}
+		variant.Properties["args"] = g.schemaFor(reflect.TypeOf(args))
+
+		name := "ReqDeploy" + strings.ToUpper(deployType[:1]) + deployType[1:]
+		g.components[name] = &variant
+		variants.OneOf = append(variants.OneOf, ref(name))
+		variants.Discriminator.Mapping[deployType] = ref(name).Ref
+	}
+	g.components["ReqDeploy"] = variants
+}
+
+func jsonContent(schema *Schema) map[string]MediaType {
+	return map[string]MediaType{
+		"application/json": {Schema: schema},
+	}
+}
+
+// responses returns the success response and the ErrorResponse of the error
+// status codes.
+func responses(status int, description string, schema *Schema, errorStatuses ...int) map[string]Response {
+	return withErrors(map[string]Response{
+		strconv.Itoa(status): {
+			Description: description,
+			Content:     jsonContent(schema),
+		},
+	}, errorStatuses...)
+}
+
+func withErrors(responses map[string]Response, errorStatuses ...int) map[string]Response {
+	for _, status := range errorStatuses {
+		responses[strconv.Itoa(status)] = Response{
+			Description: http.StatusText(status),
+			Content:     jsonContent(ref("ErrorResponse")),
+		}
+	}
+	return responses
+}
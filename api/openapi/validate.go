@@ -0,0 +1,163 @@
+package openapi
+
+import (
+	"build-machine/api/controller"
+	"build-machine/api/types"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// Validate checks a value decoded from JSON against the component schema and
+// returns the problems found, prefixed by the path of the offending value.
+func (d *Document) Validate(component string, value any) []string {
+	return d.validate(ref(component), value, "$")
+}
+
+func (d *Document) validate(schema *Schema, value any, path string) []string {
+	if schema.Ref != "" {
+		return d.validate(d.resolve(schema.Ref), value, path)
+	}
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s must not be null", path)}
+	}
+	if schema.Discriminator != nil {
+		return d.validateVariant(schema, value, path)
+	}
+
+	var problems []string
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s must be an object", path)}
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is required", path, name))
+			}
+		}
+		names := maps.Keys(object)
+		slices.Sort(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				property = schema.AdditionalProperties
+			}
+			// Unknown fields are ignored, like the handlers do
+			if property != nil {
+				problems = append(problems, d.validate(property, object[name], path+"."+name)...)
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s must be an array", path)}
+		}
+		for i, item := range array {
+			problems = append(problems, d.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s must be a string", path)}
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, text); err != nil {
+				problems = append(problems, fmt.Sprintf("%s must be a date-time", path))
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return []string{fmt.Sprintf("%s must be an integer", path)}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []string{fmt.Sprintf("%s must be a number", path)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s must be a boolean", path)}
+		}
+	}
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, value) {
+		problems = append(problems, fmt.Sprintf("%s must be one of %v", path, schema.Enum))
+	}
+	return problems
+}
+
+// validateVariant validates value against the variant named by its
+// discriminator property.
+func (d *Document) validateVariant(schema *Schema, value any, path string) []string {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return []string{fmt.Sprintf("%s must be an object", path)}
+	}
+	property := schema.Discriminator.PropertyName
+	variants := maps.Keys(schema.Discriminator.Mapping)
+	slices.Sort(variants)
+
+	name, _ := object[property].(string)
+	variant, ok := schema.Discriminator.Mapping[name]
+	if !ok {
+		return []string{fmt.Sprintf("%s.%s must be one of [%s]", path, property, strings.Join(variants, " "))}
+	}
+	return d.validate(&Schema{Ref: variant}, value, path)
+}
+
+func (d *Document) resolve(ref string) *Schema {
+	schema, ok := d.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")]
+	if !ok {
+		// The document is generated, a dangling reference is a bug
+		panic("openapi: unknown schema " + ref)
+	}
+	return schema
+}
+
+// ValidateBody rejects with 400 the requests whose JSON body doesn't match
+// the component schema. The body is put back for next.
+func ValidateBody(component string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			controller.WriteError(w, http.StatusRequestEntityTooLarge, types.CodeBodyTooLarge, fmt.Sprintf("body must not be larger than %d bytes", tooLarge.Limit))
+			return
+		}
+		if err != nil {
+			controller.WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var value any
+		if err := json.Unmarshal(body, &value); err != nil {
+			controller.WriteError(w, http.StatusBadRequest, types.CodeInvalidRequest, "body must be JSON: "+err.Error())
+			return
+		}
+		if problems := Spec().Validate(component, value); len(problems) > 0 {
+			controller.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidRequest, "body doesn't match the "+component+" schema", map[string]any{
+				"errors": problems,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
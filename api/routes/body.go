@@ -0,0 +1,17 @@
+package route
+
+import (
+	"build-machine/internal"
+	"net/http"
+)
+
+// LimitBody caps the request body at MAX_REQUEST_BODY_SIZE, reading past it
+// fails with an *http.MaxBytesError which the handlers answer with 413.
+func LimitBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, internal.GetConfig().MaxRequestBodySize)
+		}
+		next(w, r)
+	}
+}
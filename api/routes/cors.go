@@ -0,0 +1,107 @@
+package route
+
+import (
+	"build-machine/internal"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CORS applies the CORS policy of the config. The origin of allowed requests
+// is echoed back, unless any origin is allowed, and preflight requests are
+// answered without calling next.
+func CORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := internal.GetConfig().CORS
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// The response depends on the origin whether it is allowed or not
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin != "" && originAllowed(config.AllowedOrigins, origin) {
+			// The wildcard never grants credentials, the config refuses both
+			if slices.Contains(config.AllowedOrigins, "*") {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if config.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+
+			if preflight {
+				if containsFold(config.AllowedMethods, r.Header.Get("Access-Control-Request-Method")) {
+					w.Header().Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+				}
+				if headersAllowed(config.AllowedHeaders, r.Header.Get("Access-Control-Request-Headers")) {
+					w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+				}
+				if config.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+				}
+			} else if len(config.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(config.ExposedHeaders, ", "))
+			}
+		}
+
+		// Browsers enforce the policy, so disallowed preflights get an empty
+		// answer rather than an error
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// originAllowed reports whether origin matches one of the allowed origins.
+func originAllowed(allowed []string, origin string) bool {
+	originURL, err := url.Parse(origin)
+	if err != nil || originURL.Scheme == "" || originURL.Host == "" {
+		return false
+	}
+	for _, pattern := range allowed {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+
+		scheme, host, ok := strings.Cut(pattern, "://*.")
+		if !ok || !strings.EqualFold(scheme, originURL.Scheme) {
+			continue
+		}
+		// The wildcard stands for one or more labels, the domain itself
+		// is not matched
+		suffix := "." + strings.ToLower(host)
+		originHost := strings.ToLower(originURL.Host)
+		if strings.HasSuffix(originHost, suffix) && len(originHost) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed reports whether every header of the comma separated list
+// requested is allowed.
+func headersAllowed(allowed []string, requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !containsFold(allowed, header) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(candidate string) bool {
+		return strings.EqualFold(candidate, value)
+	})
+}
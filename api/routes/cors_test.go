@@ -0,0 +1,201 @@
+package route
+
+import (
+	"build-machine/internal"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// setCORSConfig applies env to the config, CORS settings are reloadable.
+func setCORSConfig(t *testing.T, env map[string]string) {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	if err := internal.ReloadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+}
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	setCORSConfig(t, map[string]string{
+		"CORS_ALLOWED_ORIGINS":   "https://app.genez.io,https://*.genezio.dev",
+		"CORS_ALLOW_CREDENTIALS": "true",
+		"CORS_EXPOSED_HEADERS":   "X-Request-Id",
+		"CORS_MAX_AGE":           "10m",
+		"CORS_ALLOWED_METHODS":   "GET,POST,OPTIONS",
+		"CORS_ALLOWED_HEADERS":   "Content-Type,Authorization",
+	})
+
+	tests := []struct {
+		name   string
+		origin string
+		want   string
+	}{
+		{"exact origin", "https://app.genez.io", "https://app.genez.io"},
+		{"wildcard subdomain", "https://my-app.genezio.dev", "https://my-app.genezio.dev"},
+		{"nested subdomain", "https://a.b.genezio.dev", "https://a.b.genezio.dev"},
+		{"wildcard excludes the domain itself", "https://genezio.dev", ""},
+		{"wildcard checks the scheme", "http://my-app.genezio.dev", ""},
+		{"suffix of another domain", "https://evilgenezio.dev", ""},
+		{"unknown origin", "https://example.com", ""},
+		{"no origin", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := CORS(okHandler)
+			req := httptest.NewRequest(http.MethodGet, "/state/job", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			if res.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", res.Code, http.StatusOK)
+			}
+			if got := res.Header().Get("Access-Control-Allow-Origin"); got != test.want {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, test.want)
+			}
+			if test.want == "" {
+				return
+			}
+			if got := res.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+			}
+			if got := res.Header().Get("Access-Control-Expose-Headers"); got != "X-Request-Id" {
+				t.Errorf("Access-Control-Expose-Headers = %q, want X-Request-Id", got)
+			}
+		})
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	setCORSConfig(t, map[string]string{
+		"CORS_ALLOWED_ORIGINS":   "*",
+		"CORS_ALLOW_CREDENTIALS": "false",
+	})
+
+	handler := CORS(okHandler)
+	req := httptest.NewRequest(http.MethodGet, "/regions", nil)
+	req.Header.Set("Origin", "https://example.com")
+	res := httptest.NewRecorder()
+	handler(res, req)
+
+	if got := res.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := res.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want none", got)
+	}
+}
+
+func TestCORSAnyOriginRejectsCredentials(t *testing.T) {
+	// Runs once the variables are restored
+	t.Cleanup(func() { internal.ReloadConfig() })
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.genez.io,*")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	if err := internal.ReloadConfig(); err == nil {
+		t.Fatal("config with * and credentials was accepted")
+	}
+	if slices.Contains(internal.GetConfig().CORS.AllowedOrigins, "*") && internal.GetConfig().CORS.AllowCredentials {
+		t.Error("rejected CORS policy was applied")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	setCORSConfig(t, map[string]string{
+		"CORS_ALLOWED_ORIGINS":   "https://*.genez.io",
+		"CORS_ALLOW_CREDENTIALS": "false",
+		"CORS_ALLOWED_METHODS":   "GET,POST,OPTIONS",
+		"CORS_ALLOWED_HEADERS":   "Content-Type,Authorization",
+		"CORS_MAX_AGE":           "10m",
+	})
+
+	tests := []struct {
+		name        string
+		origin      string
+		method      string
+		headers     string
+		wantOrigin  string
+		wantMethods string
+		wantHeaders string
+		wantMaxAge  string
+	}{
+		{
+			name:        "allowed",
+			origin:      "https://app.genez.io",
+			method:      "POST",
+			headers:     "content-type, authorization",
+			wantOrigin:  "https://app.genez.io",
+			wantMethods: "GET, POST, OPTIONS",
+			wantHeaders: "Content-Type, Authorization",
+			wantMaxAge:  "600",
+		},
+		{
+			name:        "method not allowed",
+			origin:      "https://app.genez.io",
+			method:      "DELETE",
+			wantOrigin:  "https://app.genez.io",
+			wantHeaders: "Content-Type, Authorization",
+			wantMaxAge:  "600",
+		},
+		{
+			name:        "header not allowed",
+			origin:      "https://app.genez.io",
+			method:      "GET",
+			headers:     "X-Custom",
+			wantOrigin:  "https://app.genez.io",
+			wantMethods: "GET, POST, OPTIONS",
+			wantMaxAge:  "600",
+		},
+		{
+			name:   "origin not allowed",
+			origin: "https://example.com",
+			method: "POST",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			handler := CORS(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			req := httptest.NewRequest(http.MethodOptions, "/deploy", nil)
+			req.Header.Set("Origin", test.origin)
+			req.Header.Set("Access-Control-Request-Method", test.method)
+			if test.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", test.headers)
+			}
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			if called {
+				t.Error("preflight reached the handler")
+			}
+			if res.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want %d", res.Code, http.StatusNoContent)
+			}
+			if res.Body.Len() != 0 {
+				t.Errorf("body = %q, want empty", res.Body.String())
+			}
+			wantHeaders := map[string]string{
+				"Access-Control-Allow-Origin":  test.wantOrigin,
+				"Access-Control-Allow-Methods": test.wantMethods,
+				"Access-Control-Allow-Headers": test.wantHeaders,
+				"Access-Control-Max-Age":       test.wantMaxAge,
+			}
+			for header, want := range wantHeaders {
+				if got := res.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package route
+
+import (
+	"build-machine/api/controller"
+	"build-machine/api/types"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// Methods routes a request to the handler of its method, other methods are
+// answered with 405 and the allowed ones.
+func Methods(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	allowed := maps.Keys(handlers)
+	slices.Sort(allowed)
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok && r.Method == http.MethodHead {
+			handler, ok = handlers[http.MethodGet]
+		}
+		if !ok {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			controller.WriteErrorDetails(w, http.StatusMethodNotAllowed, types.CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path, map[string]any{
+				"allowedMethods": allowed,
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// notFound answers the unknown API paths.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	controller.WriteError(w, http.StatusNotFound, types.CodeNotFound, r.URL.Path+" not found")
+}
@@ -0,0 +1,211 @@
+package route
+
+import (
+	"build-machine/api/controller"
+	"build-machine/api/types"
+	"build-machine/internal"
+	"build-machine/logging"
+	"build-machine/metrics"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long the bucket of an inactive client is kept
+const limiterIdleTimeout = 10 * time.Minute
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterSet holds one token bucket per key, buckets are dropped once they
+// are idle.
+type limiterSet struct {
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+func newLimiterSet() *limiterSet {
+	return &limiterSet{
+		limiters:  make(map[string]*limiterEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the bucket of key, updated to the current limits.
+func (s *limiterSet) get(key string, limit rate.Limit, burst int, now time.Time) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > limiterIdleTimeout {
+		for key, entry := range s.limiters {
+			if now.Sub(entry.lastSeen) > limiterIdleTimeout {
+				delete(s.limiters, key)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(limit, burst)}
+		s.limiters[key] = entry
+	}
+	entry.lastSeen = now
+	// The limits can be reloaded
+	if entry.limiter.Limit() != limit {
+		entry.limiter.SetLimitAt(now, limit)
+	}
+	if entry.limiter.Burst() != burst {
+		entry.limiter.SetBurstAt(now, burst)
+	}
+	return entry.limiter
+}
+
+// RateLimiter limits the requests of every client IP and of every user token
+// with token buckets.
+type RateLimiter struct {
+	ips    *limiterSet
+	tokens *limiterSet
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		ips:    newLimiterSet(),
+		tokens: newLimiterSet(),
+	}
+}
+
+type rateLimitCheck struct {
+	scope       string
+	reservation *rate.Reservation
+	limiter     *rate.Limiter
+}
+
+// reserve takes a token from the bucket of the check, it returns false if
+// the bucket is empty.
+func (c *rateLimitCheck) reserve(now time.Time) bool {
+	c.reservation = c.limiter.ReserveN(now, 1)
+	return c.reservation.OK() && c.reservation.DelayFrom(now) == 0
+}
+
+// Limit rejects the requests over the limits with 429 and reports the state
+// of the most constrained bucket in the X-RateLimit-* headers.
+func (l *RateLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := internal.GetConfig().RateLimit
+		if !config.Enabled || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		ipLimiter := l.ips.get(clientIP(r, config.TrustedProxies), rate.Limit(config.IPRate), config.IPBurst, now)
+		checks := []rateLimitCheck{{scope: "ip", limiter: ipLimiter}}
+		var exceeded *rateLimitCheck
+		if !checks[0].reserve(now) {
+			exceeded = &checks[0]
+		} else if token := requestToken(r); token != "" {
+			// The body is only read for the token once the IP is within its
+			// limit, so a flood is rejected before being buffered
+			tokenLimiter := l.tokens.get(token, rate.Limit(config.TokenRate), config.TokenBurst, now)
+			checks = append(checks, rateLimitCheck{scope: "token", limiter: tokenLimiter})
+			if !checks[1].reserve(now) {
+				exceeded = &checks[1]
+			}
+		}
+		if exceeded != nil {
+			// Rejected requests don't use up the buckets
+			for _, check := range checks {
+				check.reservation.CancelAt(now)
+			}
+		}
+
+		tightest := checks[0]
+		for _, check := range checks[1:] {
+			if check.limiter.TokensAt(now) < tightest.limiter.TokensAt(now) {
+				tightest = check
+			}
+		}
+		setRateLimitHeaders(w, tightest.limiter, now)
+
+		if exceeded != nil {
+			metrics.RateLimitedRequests.WithLabelValues(exceeded.scope).Inc()
+			logging.FromContext(r.Context()).Info("Rate limited request", "scope", exceeded.scope, "path", r.URL.Path)
+			// Seconds until the exceeded bucket has a token again
+			retryAfter := (1 - exceeded.limiter.TokensAt(now)) / float64(exceeded.limiter.Limit())
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter)))))
+			controller.WriteErrorDetails(w, http.StatusTooManyRequests, types.CodeRateLimited, "Too many requests", map[string]any{
+				"scope": exceeded.scope,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limiter *rate.Limiter, now time.Time) {
+	tokens := math.Max(0, limiter.TokensAt(now))
+	// Seconds until the bucket is full again
+	reset := (float64(limiter.Burst()) - tokens) / float64(limiter.Limit())
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.Burst()))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(math.Floor(tokens))))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset))))
+}
+
+// clientIP returns the address of the client. Behind trustedProxies proxies it
+// is the X-Forwarded-For hop added by the outermost one, the hops left of it
+// are set by the client.
+func clientIP(r *http.Request, trustedProxies int) string {
+	if trustedProxies > 0 {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		if len(hops) > 0 {
+			return hops[max(len(hops)-trustedProxies, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestToken returns the bearer token of the request, or the token of a
+// deploy body, which is put back for the handler. The body is bounded by
+// LimitBody.
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("Authorization"); token != "" {
+		return strings.TrimPrefix(token, "Bearer ")
+	}
+	if r.Method != http.MethodPost || r.Body == nil {
+		return ""
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return ""
+	}
+	var deploy struct {
+		Token string `json:"token"`
+	}
+	if json.Unmarshal(body, &deploy) != nil {
+		return ""
+	}
+	return deploy.Token
+}
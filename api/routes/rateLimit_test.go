@@ -0,0 +1,34 @@
+package route
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		forwarded      []string
+		trustedProxies int
+		want           string
+	}{
+		{"no proxy ignores the header", []string{"203.0.113.7"}, 0, "192.0.2.1"},
+		{"hop added by the proxy", []string{"198.51.100.9, 203.0.113.7"}, 1, "203.0.113.7"},
+		{"hop added by the outermost proxy", []string{"198.51.100.9, 203.0.113.7, 10.0.0.2"}, 2, "203.0.113.7"},
+		{"repeated headers", []string{"198.51.100.9", "203.0.113.7"}, 1, "203.0.113.7"},
+		{"fewer hops than proxies", []string{"203.0.113.7"}, 2, "203.0.113.7"},
+		{"no header", nil, 1, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/jobs", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for _, forwarded := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if got := clientIP(r, test.trustedProxies); got != test.want {
+				t.Errorf("clientIP = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
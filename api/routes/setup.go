@@ -2,37 +2,72 @@ package route
 
 import (
 	"build-machine/api/controller"
+	"build-machine/api/openapi"
 	"build-machine/internal"
+	"build-machine/service"
+	"build-machine/storage"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func CORS(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Access-Control-Allow-Credentials", "true")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+// SetupHTTP registers the routes and serves them until the server fails.
+func SetupHTTP(clusters *service.ClusterRegistry) error {
+	c := controller.NewDeploymentsController(clusters)
+	limiter := NewRateLimiter()
+	mux := http.NewServeMux()
 
-		if r.Method == "OPTIONS" {
-			http.Error(w, "No Content", http.StatusNoContent)
-			return
-		}
+	mux.Handle("/healthcheck", http.HandlerFunc(CORS(c.HealthCheck)))
+	mux.Handle("/livez", http.HandlerFunc(c.Livez))
+	mux.Handle("/readyz", http.HandlerFunc(c.Readyz))
+	mux.Handle("/metrics", promhttp.Handler())
 
-		next(w, r)
-	}
-}
+	deploy := LimitBody(limiter.Limit(openapi.ValidateBody("ReqDeploy", c.Deploy)))
 
-func SetupHTTP() {
-	c := controller.NewDeploymentsController()
-	mux := http.NewServeMux()
+	// Versioned API
+	mux.Handle("/openapi.json", http.HandlerFunc(CORS(Methods(map[string]http.HandlerFunc{
+		http.MethodGet: openapi.Handler,
+	}))))
+	mux.Handle("/v1/", http.HandlerFunc(CORS(notFound)))
+	mux.Handle("/v1/jobs", http.HandlerFunc(CORS(Methods(map[string]http.HandlerFunc{
+		http.MethodGet:  limiter.Limit(c.ListJobs),
+		http.MethodPost: deploy,
+	}))))
+	mux.Handle("/v1/jobs/{job_id}", http.HandlerFunc(CORS(Methods(map[string]http.HandlerFunc{
+		http.MethodGet: limiter.Limit(c.GetState),
+	}))))
+	mux.Handle("/v1/jobs/{job_id}/cancel", http.HandlerFunc(CORS(Methods(map[string]http.HandlerFunc{
+		http.MethodPost: c.Cancel,
+	}))))
+	mux.Handle("/v1/jobs/{job_id}/logs", http.HandlerFunc(CORS(Methods(map[string]http.HandlerFunc{
+		http.MethodGet: c.GetLogs,
+	}))))
+	mux.Handle("/v1/regions", http.HandlerFunc(CORS(Methods(map[string]http.HandlerFunc{
+		http.MethodGet: c.GetRegions,
+	}))))
 
-	mux.Handle("/healthcheck", http.HandlerFunc(CORS(c.HealthCheck)))
-	mux.Handle("/deploy", http.HandlerFunc(CORS(c.Deploy)))
-	mux.Handle("/state/{job_id}", http.HandlerFunc(CORS(c.GetState)))
+	// Unversioned paths of the first clients, they accept any method except
+	// cancel, which a crawler or prefetch must not trigger
+	mux.Handle("/deploy", http.HandlerFunc(CORS(deploy)))
+	mux.Handle("/state/{job_id}", http.HandlerFunc(CORS(limiter.Limit(c.LegacyGetState))))
+	mux.Handle("/regions", http.HandlerFunc(CORS(c.GetRegions)))
+	mux.Handle("/cancel/{job_id}", http.HandlerFunc(CORS(Methods(map[string]http.HandlerFunc{
+		http.MethodPost: c.Cancel,
+	}))))
+	mux.Handle("/logs/{job_id}", http.HandlerFunc(CORS(c.GetLogs)))
+
+	// The local artifact store serves archives to the builders itself
+	store, err := storage.GetArtifactStore()
+	if err != nil {
+		return fmt.Errorf("failed to create artifact store: %v", err)
+	}
+	if handler, ok := store.(http.Handler); ok {
+		mux.Handle("/artifacts/", handler)
+	}
 	serverPort := internal.GetConfig().ServerPort
-	fmt.Println("Server running on port", serverPort)
+	slog.Info("Server running", "port", serverPort)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", serverPort), mux))
+	return http.ListenAndServe(fmt.Sprintf(":%s", serverPort), Tracing(RequestID(mux)))
 }
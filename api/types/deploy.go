@@ -0,0 +1,70 @@
+// Package types holds the requests, responses and errors of the API. It is
+// shared by the server and the client, so it only depends on the standard
+// library and the state manager types.
+package types
+
+import (
+	"encoding/json"
+)
+
+const (
+	// IdempotencyKeyHeader makes retrying a deploy safe, repeats of a request
+	// with the same key return the build queued by the first one
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for a known key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+type ReqDeploy struct {
+	Token string          `json:"token" required:"true"`
+	Type  string          `json:"type" required:"true"`
+	Stage string          `json:"stage"`
+	Args  json.RawMessage `json:"args" required:"true"`
+	// Builder optionally picks the builder image, size and disk
+	Builder BuilderOptions `json:"builder"`
+}
+
+type ResDeploy struct {
+	JobID         string `json:"jobID" required:"true"`
+	Status        string `json:"status" required:"true"`
+	QueuePosition int    `json:"queuePosition,omitempty"`
+}
+
+// BuilderOptions are the builder settings a deploy can ask for.
+type BuilderOptions struct {
+	// Image is an image variant of the builder config, e.g. node20
+	Image string `json:"image,omitempty"`
+	// Size is a size class of the builder config
+	Size string `json:"size,omitempty"`
+	// Disk is the ephemeral disk of the builder, e.g. 10Gi
+	Disk string `json:"disk,omitempty"`
+}
+
+// DeploymentArgs holds the args type of every deploy type.
+var DeploymentArgs = map[string]any{
+	"git": GitDeployment{},
+	"s3":  S3Deployment{},
+}
+
+// Specific input definitions for each workflow type
+type GitDeployment struct {
+	Repository   string   `json:"githubRepository" required:"true"`
+	ProjectName  string   `json:"projectName" required:"true"`
+	Region       string   `json:"region" required:"true"`
+	Stage        string   `json:"stage"`
+	BasePath     *string  `json:"basePath,omitempty"`
+	Stack        []string `json:"stack,omitempty"`
+	IsNewProject bool     `json:"isNewProject"`
+}
+
+type S3Deployment struct {
+	S3DownloadURL string            `json:"s3DownloadURL,omitempty"`
+	ProjectName   string            `json:"projectName" required:"true"`
+	Stage         string            `json:"stage"`
+	Region        string            `json:"region" required:"true"`
+	BasePath      *string           `json:"basePath,omitempty"`
+	Code          map[string]string `json:"code"`
+	// CodeBase64 holds the files with binary content, base64 encoded, as JSON
+	// strings can't carry them
+	CodeBase64 map[string]string `json:"codeBase64,omitempty"`
+}
@@ -0,0 +1,25 @@
+package types
+
+// Error codes of ErrorResponse.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeRateLimited      = "rate_limited"
+	CodeLimitExceeded    = "limit_exceeded"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeArchiveTooLarge  = "archive_too_large"
+	CodeInternal         = "internal_error"
+	CodeUnavailable      = "unavailable"
+)
+
+// ErrorResponse is the body of every error returned by the API.
+type ErrorResponse struct {
+	Code    string `json:"code" required:"true"`
+	Message string `json:"message" required:"true"`
+	Details any    `json:"details,omitempty"`
+	// RequestID is the X-Request-Id of the request, to be quoted in reports
+	RequestID string `json:"requestId,omitempty"`
+}
@@ -0,0 +1,34 @@
+package types
+
+import (
+	statemanager "build-machine/state_manager"
+	"time"
+)
+
+type ResGetState struct {
+	BuildEngine string                         `json:"buildEngine" required:"true"`
+	BuildStatus statemanager.BuildStatus       `json:"buildStatus" required:"true"`
+	Timestamp   time.Time                      `json:"timestamp" required:"true"`
+	Transitions []statemanager.StateTransition `json:"transitions" required:"true"`
+	// QueuePosition is set while the build is QUEUED, 1 is the next build
+	QueuePosition int                       `json:"queuePosition,omitempty"`
+	Cluster       string                    `json:"cluster,omitempty"`
+	Namespace     string                    `json:"namespace,omitempty"`
+	Archive       *statemanager.ArchiveInfo `json:"archive,omitempty"`
+}
+
+type ResJob struct {
+	JobID       string                   `json:"jobID" required:"true"`
+	BuildEngine string                   `json:"buildEngine" required:"true"`
+	BuildStatus statemanager.BuildStatus `json:"buildStatus" required:"true"`
+	CreatedAt   time.Time                `json:"createdAt" required:"true"`
+	Timestamp   time.Time                `json:"timestamp" required:"true"`
+}
+
+type ResListJobs struct {
+	Jobs []ResJob `json:"jobs" required:"true"`
+}
+
+type ResGetRegions struct {
+	Regions []string `json:"regions" required:"true"`
+}
@@ -0,0 +1,293 @@
+// Package client calls the /v1 API of the build machine.
+package client
+
+import (
+	"build-machine/api/types"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client calls the build machine with the token of a genezio user.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	retry      RetryPolicy
+}
+
+// RetryPolicy sets how failed requests are retried, with an exponential
+// backoff between MinBackoff and MaxBackoff.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 4,
+	MinBackoff: 500 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sends the requests with httpClient instead of http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// New returns a client of the build machine at baseURL, e.g.
+// https://build.genez.io, authenticated with token.
+func New(baseURL, token string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: http.DefaultClient,
+		retry:      DefaultRetryPolicy,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// APIError is an error response of the build machine.
+type APIError struct {
+	StatusCode int
+	types.ErrorResponse
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%s: %s (request %s)", e.Code, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// IsStatus reports whether err is an APIError with the status code.
+func IsStatus(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// DeployOptions are the optional settings of a deploy.
+type DeployOptions struct {
+	Stage   string
+	Builder types.BuilderOptions
+	// IdempotencyKey identifies the deploy so it can be retried without
+	// queueing a second build, a random key is used if empty
+	IdempotencyKey string
+}
+
+// DeployGit queues a build of a git repository.
+func (c *Client) DeployGit(ctx context.Context, args types.GitDeployment, options DeployOptions) (*types.ResDeploy, error) {
+	return c.Deploy(ctx, "git", args, options)
+}
+
+// DeployS3 queues a build of uploaded code.
+func (c *Client) DeployS3(ctx context.Context, args types.S3Deployment, options DeployOptions) (*types.ResDeploy, error) {
+	return c.Deploy(ctx, "s3", args, options)
+}
+
+// Deploy queues a build of deployType, args is the matching type of
+// types.DeploymentArgs.
+func (c *Client) Deploy(ctx context.Context, deployType string, args any, options DeployOptions) (*types.ResDeploy, error) {
+	rawArgs, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(types.ReqDeploy{
+		Token:   c.token,
+		Type:    deployType,
+		Stage:   options.Stage,
+		Args:    rawArgs,
+		Builder: options.Builder,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	idempotencyKey := options.IdempotencyKey
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.NewString()
+	}
+	header := http.Header{}
+	header.Set(types.IdempotencyKeyHeader, idempotencyKey)
+
+	var res types.ResDeploy
+	// Retries carry the same key, so a build queued before the response was
+	// lost is returned instead of being queued again
+	err = c.do(ctx, http.MethodPost, "/v1/jobs", header, body, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetState returns the state of the build jobID.
+func (c *Client) GetState(ctx context.Context, jobID string) (*types.ResGetState, error) {
+	var res types.ResGetState
+	if err := c.do(ctx, http.MethodGet, "/v1/jobs/"+url.PathEscape(jobID), nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListJobs returns the latest builds of the user, newest first. A limit of 0
+// uses the default of the server.
+func (c *Client) ListJobs(ctx context.Context, limit int) ([]types.ResJob, error) {
+	path := "/v1/jobs"
+	if limit > 0 {
+		path += "?limit=" + strconv.Itoa(limit)
+	}
+	var res types.ResListJobs
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Jobs, nil
+}
+
+// Cancel stops the build jobID.
+func (c *Client) Cancel(ctx context.Context, jobID string) (*types.ResDeploy, error) {
+	var res types.ResDeploy
+	// Repeating a cancel is harmless, a second one fails with 409
+	if err := c.do(ctx, http.MethodPost, "/v1/jobs/"+url.PathEscape(jobID)+"/cancel", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Regions lists the regions builds can deploy to.
+func (c *Client) Regions(ctx context.Context) ([]string, error) {
+	var res types.ResGetRegions
+	if err := c.do(ctx, http.MethodGet, "/v1/regions", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Regions, nil
+}
+
+// Logs returns the output of the builder of jobID. With follow the stream
+// stays open until the build exits or ctx is done.
+func (c *Client) Logs(ctx context.Context, jobID string, follow bool) (io.ReadCloser, error) {
+	path := "/v1/jobs/" + url.PathEscape(jobID) + "/logs"
+	if follow {
+		path += "?follow=true"
+	}
+	res, err := c.send(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, out any) error {
+	res, err := c.send(ctx, method, path, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// send performs the request with retries and returns the first successful
+// response, error responses are turned into an APIError.
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := c.httpClient.Do(req)
+		if err == nil && res.StatusCode < http.StatusBadRequest {
+			return res, nil
+		}
+
+		var retryAfter time.Duration
+		retryable := false
+		if err != nil {
+			retryable = ctx.Err() == nil
+		} else {
+			apiErr := readAPIError(res)
+			err = apiErr
+			switch res.StatusCode {
+			case http.StatusTooManyRequests, http.StatusConflict:
+				// Only the rate limiter clears within the backoff, the
+				// build limits don't. A conflict is only retried while the
+				// first request with the same idempotency key is in
+				// progress, which sets Retry-After
+				seconds, parseErr := strconv.Atoi(res.Header.Get("Retry-After"))
+				if res.StatusCode == http.StatusTooManyRequests {
+					retryable = apiErr.Code == types.CodeRateLimited
+				} else {
+					retryable = parseErr == nil
+				}
+				if parseErr == nil {
+					retryAfter = time.Duration(seconds) * time.Second
+				}
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				retryable = true
+			}
+		}
+		if !retryable || attempt >= c.retry.MaxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(max(retryAfter, c.backoff(attempt))):
+		}
+	}
+}
+
+// backoff returns the wait before the retry following attempt, with jitter.
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := c.retry.MinBackoff << attempt
+	if backoff > c.retry.MaxBackoff || backoff <= 0 {
+		backoff = c.retry.MaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func readAPIError(res *http.Response) *APIError {
+	defer res.Body.Close()
+	apiErr := &APIError{StatusCode: res.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if json.Unmarshal(body, &apiErr.ErrorResponse) != nil || apiErr.Code == "" {
+		// Not an API error, e.g. from a proxy
+		apiErr.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(res.StatusCode), " ", "_"))
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"build-machine/api/types"
+	statemanager "build-machine/state_manager"
+	"context"
+	"time"
+)
+
+// WaitOptions configure WaitForCompletion.
+type WaitOptions struct {
+	// PollInterval is the time between two state requests, 2s when unset
+	PollInterval time.Duration
+	// OnTransition is called once for every transition of the build, in order
+	OnTransition func(statemanager.StateTransition)
+}
+
+// WaitForCompletion follows the build jobID until it reaches a terminal status
+// and returns its final state.
+func (c *Client) WaitForCompletion(ctx context.Context, jobID string, options WaitOptions) (*types.ResGetState, error) {
+	interval := options.PollInterval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	seen := 0
+	for {
+		state, err := c.GetState(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if options.OnTransition != nil {
+			for _, transition := range state.Transitions[min(seen, len(state.Transitions)):] {
+				options.OnTransition(transition)
+			}
+		}
+		seen = len(state.Transitions)
+		if state.BuildStatus.IsTerminal() {
+			return state, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"build-machine/api/types"
+	"build-machine/client"
+	statemanager "build-machine/state_manager"
+	"build-machine/utils"
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// deployFlags are the flags of both deploy types.
+type deployFlags struct {
+	options
+	project  string
+	region   string
+	stage    string
+	basePath string
+	builder  types.BuilderOptions
+	wait     bool
+}
+
+func (f *deployFlags) register(flags *flag.FlagSet) {
+	f.options.register(flags)
+	flags.StringVar(&f.project, "project", "", "project name (required)")
+	flags.StringVar(&f.region, "region", "", "region to deploy to (required)")
+	flags.StringVar(&f.stage, "stage", "prod", "stage to deploy")
+	flags.StringVar(&f.basePath, "base-path", "", "path of the project in the code")
+	flags.StringVar(&f.builder.Image, "image", "", "builder image variant, e.g. node20")
+	flags.StringVar(&f.builder.Size, "size", "", "builder size class")
+	flags.StringVar(&f.builder.Disk, "disk", "", "builder disk size, e.g. 10Gi")
+	flags.BoolVar(&f.wait, "wait", false, "follow the build and fail if it fails")
+}
+
+func (f *deployFlags) validate() error {
+	if f.project == "" || f.region == "" {
+		return fmt.Errorf("--project and --region are required")
+	}
+	return nil
+}
+
+func (f *deployFlags) basePathArg() *string {
+	if f.basePath == "" {
+		return nil
+	}
+	return &f.basePath
+}
+
+func deploy(ctx context.Context, args []string) error {
+	if len(args) == 0 || (args[0] != "git" && args[0] != "s3") {
+		return fmt.Errorf("usage: buildctl deploy git|s3 [flags]")
+	}
+	if args[0] == "git" {
+		return deployGit(ctx, args[1:])
+	}
+	return deployS3(ctx, args[1:])
+}
+
+func deployGit(ctx context.Context, args []string) error {
+	var f deployFlags
+	var repository, stack string
+	var newProject bool
+	flags := flag.NewFlagSet("deploy git", flag.ContinueOnError)
+	f.register(flags)
+	flags.StringVar(&repository, "repo", "", "GitHub repository URL (required)")
+	flags.StringVar(&stack, "stack", "", "comma separated stack of the project")
+	flags.BoolVar(&newProject, "new-project", false, "the project is deployed for the first time")
+	if _, err := parse(flags, args, 0, ""); err != nil {
+		return err
+	}
+	if err := f.validate(); err != nil {
+		return err
+	}
+	if repository == "" {
+		return fmt.Errorf("--repo is required")
+	}
+
+	c, err := f.client()
+	if err != nil {
+		return err
+	}
+	deployment := types.GitDeployment{
+		Repository:   repository,
+		ProjectName:  f.project,
+		Region:       f.region,
+		Stage:        f.stage,
+		BasePath:     f.basePathArg(),
+		IsNewProject: newProject,
+	}
+	if stack != "" {
+		deployment.Stack = strings.Split(stack, ",")
+	}
+	res, err := c.DeployGit(ctx, deployment, client.DeployOptions{Stage: f.stage, Builder: f.builder})
+	if err != nil {
+		return err
+	}
+	return f.queued(ctx, c, res)
+}
+
+func deployS3(ctx context.Context, args []string) error {
+	var f deployFlags
+	flags := flag.NewFlagSet("deploy s3", flag.ContinueOnError)
+	f.register(flags)
+	args, err := parse(flags, args, 1, "<dir>")
+	if err != nil {
+		return err
+	}
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	c, err := f.client()
+	if err != nil {
+		return err
+	}
+	code, binary, err := codeMap(args[0])
+	if err != nil {
+		return err
+	}
+	res, err := c.DeployS3(ctx, types.S3Deployment{
+		ProjectName: f.project,
+		Region:      f.region,
+		Stage:       f.stage,
+		BasePath:    f.basePathArg(),
+		Code:        code,
+		CodeBase64:  binary,
+	}, client.DeployOptions{Stage: f.stage, Builder: f.builder})
+	if err != nil {
+		return err
+	}
+	return f.queued(ctx, c, res)
+}
+
+// codeMap reads the files of dir, with the exclusions the build machine
+// applies to uploaded code, into the code maps of the s3 deploy. JSON strings
+// can't hold binary data, so those files are returned base64 encoded.
+func codeMap(dir string) (code, binary map[string]string, err error) {
+	code = make(map[string]string)
+	binary = make(map[string]string)
+	err = utils.WalkDirectory(dir, func(filePath, name string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if utf8.Valid(content) {
+			code[name] = string(content)
+		} else {
+			binary[name] = base64.StdEncoding.EncodeToString(content)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+	return code, binary, nil
+}
+
+// queued prints the queued build and follows it with --wait.
+func (f *deployFlags) queued(ctx context.Context, c *client.Client, res *types.ResDeploy) error {
+	if !f.wait {
+		return f.print(res, func() {
+			fmt.Printf("Job %s %s", res.JobID, res.Status)
+			if res.QueuePosition > 0 {
+				fmt.Printf(", position %d in the queue", res.QueuePosition)
+			}
+			fmt.Println()
+		})
+	}
+
+	if !f.json {
+		fmt.Printf("Job %s %s\n", res.JobID, res.Status)
+	}
+	state, err := c.WaitForCompletion(ctx, res.JobID, client.WaitOptions{
+		OnTransition: func(transition statemanager.StateTransition) {
+			if !f.json {
+				fmt.Printf("%s %s %s\n", transition.TransitionTime.Format(time.TimeOnly), transition.To, transition.Reason)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if f.json {
+		if err := f.print(state, nil); err != nil {
+			return err
+		}
+	}
+	if state.BuildStatus != statemanager.StatusSuccess && state.BuildStatus != statemanager.StatusSucceeded {
+		if !f.json {
+			fmt.Fprintf(os.Stderr, "Build %s\n", state.BuildStatus)
+		}
+		return errBuildFailed
+	}
+	return nil
+}
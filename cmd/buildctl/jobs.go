@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func status(ctx context.Context, args []string) error {
+	var o options
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	o.register(flags)
+	args, err := parse(flags, args, 1, "<job>")
+	if err != nil {
+		return err
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	state, err := c.GetState(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return o.print(state, func() {
+		fmt.Printf("Job:     %s\n", args[0])
+		fmt.Printf("Status:  %s\n", state.BuildStatus)
+		if state.QueuePosition > 0 {
+			fmt.Printf("Queue:   position %d\n", state.QueuePosition)
+		}
+		if state.Cluster != "" {
+			fmt.Printf("Cluster: %s/%s\n", state.Cluster, state.Namespace)
+		}
+		fmt.Printf("Updated: %s\n", state.Timestamp.Format(time.RFC3339))
+		if len(state.Transitions) == 0 {
+			return
+		}
+
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tSTATUS\tREASON")
+		for _, transition := range state.Transitions {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", transition.TransitionTime.Format(time.RFC3339), transition.To, transition.Reason)
+		}
+		w.Flush()
+	})
+}
+
+func logs(ctx context.Context, args []string) error {
+	var o options
+	var follow bool
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	o.register(flags)
+	flags.BoolVar(&follow, "f", false, "follow the logs until the build exits")
+	args, err := parse(flags, args, 1, "<job>")
+	if err != nil {
+		return err
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	stream, err := c.Logs(ctx, args[0], follow)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = io.Copy(os.Stdout, stream)
+	if ctx.Err() != nil {
+		// Interrupted while following
+		return nil
+	}
+	return err
+}
+
+func cancel(ctx context.Context, args []string) error {
+	var o options
+	flags := flag.NewFlagSet("cancel", flag.ContinueOnError)
+	o.register(flags)
+	args, err := parse(flags, args, 1, "<job>")
+	if err != nil {
+		return err
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Cancel(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return o.print(res, func() {
+		fmt.Printf("Job %s %s\n", res.JobID, res.Status)
+	})
+}
+
+func list(ctx context.Context, args []string) error {
+	var o options
+	var limit int
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	o.register(flags)
+	flags.IntVar(&limit, "limit", 20, "maximum number of builds")
+	if _, err := parse(flags, args, 0, ""); err != nil {
+		return err
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	jobs, err := c.ListJobs(ctx, limit)
+	if err != nil {
+		return err
+	}
+	return o.print(jobs, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tSTATUS\tCREATED\tUPDATED")
+		for _, job := range jobs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", job.JobID, job.BuildStatus, job.CreatedAt.Format(time.RFC3339), job.Timestamp.Format(time.RFC3339))
+		}
+		w.Flush()
+	})
+}
@@ -0,0 +1,133 @@
+// Command buildctl submits and follows builds of the build machine.
+//
+// Usage:
+//
+//	buildctl deploy git [flags]
+//	buildctl deploy s3 [flags] <dir>
+//	buildctl status [flags] <job>
+//	buildctl logs [-f] [flags] <job>
+//	buildctl cancel [flags] <job>
+//	buildctl list [flags]
+//
+// The server and the genezio token are read from BUILD_MACHINE_URL and
+// GENEZIO_TOKEN, or from the --url and --token flags.
+package main
+
+import (
+	"build-machine/client"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+const usage = `Usage: buildctl <command> [flags] [args]
+
+Commands:
+  deploy git   queue a build of a git repository
+  deploy s3    queue a build of a local directory
+  status       show the state of a build
+  logs         print the logs of a build, -f follows them
+  cancel       cancel a build
+  list         list your latest builds
+
+Run buildctl <command> -h for the flags of a command.
+`
+
+// errBuildFailed makes buildctl exit with 1 without printing anything more.
+var errBuildFailed = errors.New("build failed")
+
+// options are the flags shared by every command.
+type options struct {
+	url   string
+	token string
+	json  bool
+}
+
+func (o *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.url, "url", envOr("BUILD_MACHINE_URL", "http://localhost:8080"), "build machine URL")
+	flags.StringVar(&o.token, "token", os.Getenv("GENEZIO_TOKEN"), "genezio token")
+	flags.BoolVar(&o.json, "json", false, "print JSON instead of text")
+}
+
+func (o *options) client() (*client.Client, error) {
+	if o.token == "" {
+		return nil, fmt.Errorf("a token is required, set GENEZIO_TOKEN or --token")
+	}
+	return client.New(o.url, o.token), nil
+}
+
+// print writes value as JSON with --json, otherwise it calls text.
+func (o *options) print(value any, text func()) error {
+	if !o.json {
+		text()
+		return nil
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+type command func(ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"deploy": deploy,
+	"status": status,
+	"logs":   logs,
+	"cancel": cancel,
+	"list":   list,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "-h" && os.Args[1] != "--help" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "buildctl: unknown command %q\n\n", os.Args[1])
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := run(ctx, os.Args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		if !errors.Is(err, errBuildFailed) {
+			fmt.Fprintf(os.Stderr, "buildctl: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// parse parses the flags of a command taking wantArgs arguments.
+func parse(flags *flag.FlagSet, args []string, wantArgs int, argsUsage string) ([]string, error) {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: buildctl %s [flags] %s\n\nFlags:\n", flags.Name(), argsUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != wantArgs {
+		flags.Usage()
+		return nil, flag.ErrHelp
+	}
+	return flags.Args(), nil
+}
+
+func envOr(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
@@ -2,8 +2,45 @@ package main
 
 import (
 	route "build-machine/api/routes"
+	"build-machine/internal"
+	"build-machine/logging"
+	"build-machine/service"
+	"build-machine/tracing"
+	"context"
+	"log/slog"
+	"os"
 )
 
 func main() {
-	route.SetupHTTP()
+	if err := internal.LoadConfig(); err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	logging.Setup()
+	internal.WatchConfigReload()
+
+	if err := internal.LoadDeployConfig(); err != nil {
+		slog.Error("Invalid deploy configuration", "error", err)
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+
+	// Connect to the default cluster up front, readiness reports it if this fails
+	clusters := service.NewClusterRegistry()
+	if _, err := clusters.Default(); err != nil {
+		slog.Warn("Build cluster is not reachable yet", "error", err)
+	}
+
+	err = route.SetupHTTP(clusters)
+	slog.Error("Server stopped", "error", err)
+	// Export the spans recorded so far before exiting
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	os.Exit(1)
 }
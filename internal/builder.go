@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// BuilderConfig lists the builder variants deploys can ask for.
+type BuilderConfig struct {
+	// Images maps image variants, e.g. node20, to container images
+	Images map[string]string `json:"images,omitempty"`
+	// DefaultImage is the variant of builds not asking for one, the image of
+	// the workflow template is used when empty
+	DefaultImage string `json:"defaultImage,omitempty"`
+	// Sizes maps size classes to the CPU and memory requested for the builder
+	Sizes map[string]BuilderSize `json:"sizes,omitempty"`
+	// MaxDisk is the largest ephemeral disk a build can request
+	MaxDisk string `json:"maxDisk,omitempty"`
+}
+
+type BuilderSize struct {
+	CPU    string `json:"cpu"`
+	Memory string `json:"memory"`
+}
+
+func (b BuilderConfig) Validate() error {
+	for variant, image := range b.Images {
+		if image == "" {
+			return fmt.Errorf("image %s: image is required", variant)
+		}
+	}
+	if _, ok := b.Images[b.DefaultImage]; b.DefaultImage != "" && !ok {
+		return fmt.Errorf("default image %s is not configured", b.DefaultImage)
+	}
+	for class, size := range b.Sizes {
+		if err := validateQuantities(map[string]string{"cpu": size.CPU, "memory": size.Memory}, true); err != nil {
+			return fmt.Errorf("size %s: %v", class, err)
+		}
+	}
+	return validateQuantities(map[string]string{"maxDisk": b.MaxDisk}, false)
+}
+
+// validateQuantities checks that the values are Kubernetes quantities, empty
+// values are only accepted if they aren't required.
+func validateQuantities(quantities map[string]string, required bool) error {
+	for name, quantity := range quantities {
+		if quantity == "" {
+			if required {
+				return fmt.Errorf("%s is required", name)
+			}
+			continue
+		}
+		if _, err := resource.ParseQuantity(quantity); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
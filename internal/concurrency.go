@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	// ConcurrencyQueue starts the build once the one in progress is over.
+	ConcurrencyQueue = "queue"
+	// ConcurrencyReject refuses the deploy while a build is in progress.
+	ConcurrencyReject = "reject"
+	// ConcurrencySupersede cancels the build in progress in favour of the new one.
+	ConcurrencySupersede = "supersede"
+)
+
+var ConcurrencyPolicies = []string{
+	ConcurrencyQueue,
+	ConcurrencyReject,
+	ConcurrencySupersede,
+}
+
+// ConcurrencyConfig sets what happens to a deploy of a project stage that
+// already has a build in progress.
+type ConcurrencyConfig struct {
+	// Policy applies to the project stages without an override, queue when empty
+	Policy string `json:"policy,omitempty"`
+	// Projects override the policy of some projects
+	Projects []ProjectConcurrency `json:"projects,omitempty"`
+}
+
+type ProjectConcurrency struct {
+	ProjectName string `json:"projectName"`
+	// Stage limits the override to one stage of the project, all of them when empty
+	Stage  string `json:"stage,omitempty"`
+	Policy string `json:"policy"`
+}
+
+func (c ConcurrencyConfig) Validate() error {
+	if c.Policy != "" && !slices.Contains(ConcurrencyPolicies, c.Policy) {
+		return fmt.Errorf("unknown policy %q, one of %v", c.Policy, ConcurrencyPolicies)
+	}
+	for _, project := range c.Projects {
+		if project.ProjectName == "" {
+			return fmt.Errorf("projectName is required")
+		}
+		if !slices.Contains(ConcurrencyPolicies, project.Policy) {
+			return fmt.Errorf("project %s: unknown policy %q, one of %v", project.ProjectName, project.Policy, ConcurrencyPolicies)
+		}
+	}
+	return nil
+}
+
+// PolicyFor returns the policy of a project stage, an override of the stage
+// wins over one of the whole project.
+func (c ConcurrencyConfig) PolicyFor(projectName, stage string) string {
+	policy := c.Policy
+	if policy == "" {
+		policy = ConcurrencyQueue
+	}
+	for _, project := range c.Projects {
+		if project.ProjectName != projectName {
+			continue
+		}
+		if project.Stage == stage {
+			return project.Policy
+		}
+		if project.Stage == "" {
+			policy = project.Policy
+		}
+	}
+	return policy
+}
@@ -1,56 +1,424 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+// Fields are read from the environment variable named by the key tag, nested
+// structs prefix the keys of their fields with their prefix tag.
+//
+// Supported tags:
+//   - default: value used when the variable is not set or empty
+//   - required: the value must not be empty once defaults are applied
+//   - secret: the value may also be read from the file named by <KEY>_FILE
+//   - reload: the field is updated in place when the process receives SIGHUP
 type configStruct struct {
-	ServerPort          string `key:"SERVER_PORT" default:"8080"`
-	BackendURL          string `key:"BACKEND_URL" default:"https://dev.api.genez.io"`
-	AWSAccessKeyID      string `key:"AWS_ACCESS_KEY_ID"`
-	AWSSecretAccessKey  string `key:"AWS_SECRET_ACCESS_KEY"`
+	ServerPort          string `key:"SERVER_PORT" default:"8080" required:"true"`
+	BackendURL          string `key:"BACKEND_URL" default:"https://dev.api.genez.io" required:"true"`
+	AWSAccessKeyID      string `key:"AWS_ACCESS_KEY_ID" secret:"true"`
+	AWSSecretAccessKey  string `key:"AWS_SECRET_ACCESS_KEY" secret:"true"`
 	BucketBaseName      string `key:"BUCKET_BASE_NAME"`
-	MaxConcurrentBuilds string `key:"MAX_CONCURRENT_BUILDS" default:"3"`
+	MaxConcurrentBuilds int    `key:"MAX_CONCURRENT_BUILDS" default:"3" reload:"true"`
+	// Build queue, a global limit of 0 only leaves the cluster capacities and
+	// 0 builds queued per user is no limit
+	MaxGlobalConcurrentBuilds int `key:"MAX_GLOBAL_CONCURRENT_BUILDS" reload:"true"`
+	MaxQueuedBuildsPerUser    int `key:"MAX_QUEUED_BUILDS_PER_USER" default:"10" reload:"true"`
+	// Source archives
+	ArchiveCompressionLevel int   `key:"ARCHIVE_COMPRESSION_LEVEL" default:"6" reload:"true"`
+	MaxArchiveSize          int64 `key:"MAX_ARCHIVE_SIZE" default:"268435456" reload:"true"`
+	// Largest request body accepted, deploy bodies carry the code map
+	MaxRequestBodySize int64 `key:"MAX_REQUEST_BODY_SIZE" default:"67108864" reload:"true"`
+	// Artifact storage
+	Artifacts artifactsConfig `prefix:"ARTIFACT_"`
+	// Optional YAML/JSON file with per region buckets, credentials and clusters
+	ConfigFile string `key:"CONFIG_FILE"`
+	// Deploy regions, used when CONFIG_FILE is not set
+	DeployRegions []string `key:"DEPLOY_REGIONS"`
 	// Environment
-	Env string `key:"ENV" default:"local"`
+	Env string `key:"ENV" default:"local" required:"true"`
+	// Logging, level is one of debug, info, warn, error and format one of text, json
+	LogLevel  string `key:"LOG_LEVEL" default:"info"`
+	LogFormat string `key:"LOG_FORMAT" default:"text"`
+	// Tracing
+	Tracing tracingConfig
+	// Namespaces the builds run in
+	Namespaces namespacesConfig `prefix:"K8S_"`
+	// Rate limits of the deploy and state endpoints
+	RateLimit rateLimitConfig `prefix:"RATE_LIMIT_"`
+	// CORS policy of the API
+	CORS corsConfig `prefix:"CORS_"`
 
-	// Kubernetes
-	AccessKeyCluster       string `key:"ACCESS_KEY_CLUSTER"`
-	AccessKeySecretCluster string `key:"ACCESS_KEY_SECRET_CLUSTER"`
+	// Kubernetes, the kubeconfig is only used in the local environment
+	Kubeconfig             string `key:"KUBECONFIG"`
+	AccessKeyCluster       string `key:"ACCESS_KEY_CLUSTER" secret:"true"`
+	AccessKeySecretCluster string `key:"ACCESS_KEY_SECRET_CLUSTER" secret:"true"`
 	BuildClusterName       string `key:"BUILD_CLUSTER_NAME"`
+	BuildClusterRegion     string `key:"BUILD_CLUSTER_REGION" default:"us-east-1"`
+	BuildClusterCapacity   int    `key:"BUILD_CLUSTER_CAPACITY"`
 }
 
-var config *configStruct
+type artifactsConfig struct {
+	// One of aws, s3 (any S3 compatible service) or local
+	Store       string `key:"STORE" default:"aws" required:"true"`
+	S3Endpoint  string `key:"S3_ENDPOINT"`
+	S3Bucket    string `key:"S3_BUCKET"`
+	S3PathStyle bool   `key:"S3_PATH_STYLE" default:"true"`
+	LocalDir    string `key:"LOCAL_DIR" default:"/tmp/genezio-artifacts"`
+	PublicURL   string `key:"PUBLIC_URL" default:"http://localhost:8080"`
+}
 
-func loadConfigFromEnv() {
-	err := godotenv.Load()
+type tracingConfig struct {
+	// OTLP/HTTP collector URL, tracing spans are not exported when empty
+	Endpoint    string  `key:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	SampleRatio float64 `key:"TRACING_SAMPLE_RATIO" default:"1"`
+}
+
+type rateLimitConfig struct {
+	Enabled bool `key:"ENABLED" default:"true" reload:"true"`
+	// Requests per second and burst allowed per client IP and per user token
+	IPRate     float64 `key:"IP_RATE" default:"10" reload:"true"`
+	IPBurst    int     `key:"IP_BURST" default:"30" reload:"true"`
+	TokenRate  float64 `key:"TOKEN_RATE" default:"5" reload:"true"`
+	TokenBurst int     `key:"TOKEN_BURST" default:"20" reload:"true"`
+	// TrustedProxies is the number of proxies in front of the API appending
+	// to X-Forwarded-For, the client IP is the hop the outermost one added.
+	// 0 uses the address of the connection.
+	TrustedProxies int `key:"TRUSTED_PROXIES"`
+}
+
+type corsConfig struct {
+	// AllowedOrigins are origins like https://app.genez.io, a * label allows
+	// any subdomain, e.g. https://*.genez.io, and a lone * any origin
+	AllowedOrigins   []string      `key:"ALLOWED_ORIGINS" default:"*" reload:"true"`
+	AllowedMethods   []string      `key:"ALLOWED_METHODS" default:"GET,POST,PUT,DELETE,OPTIONS" reload:"true"`
+	AllowedHeaders   []string      `key:"ALLOWED_HEADERS" default:"Content-Type,Content-Length,Accept-Encoding,X-CSRF-Token,Authorization,Accept,Origin,Cache-Control,X-Requested-With,X-Request-Id,Idempotency-Key,traceparent,tracestate" reload:"true"`
+	ExposedHeaders   []string      `key:"EXPOSED_HEADERS" default:"X-Request-Id,Idempotent-Replayed,Retry-After,X-RateLimit-Limit,X-RateLimit-Remaining,X-RateLimit-Reset" reload:"true"`
+	MaxAge           time.Duration `key:"MAX_AGE" default:"10m" reload:"true"`
+	AllowCredentials bool          `key:"ALLOW_CREDENTIALS" reload:"true"`
+}
+
+type namespacesConfig struct {
+	// Namespace of the builds, or of the shared resources copied to the
+	// tenant namespaces when PerTenant is set
+	Namespace string `key:"NAMESPACE" default:"default" required:"true"`
+	// PerTenant runs the builds of every user in its own namespace, created on
+	// demand. The workflow templates must then be installed as
+	// ClusterWorkflowTemplates.
+	PerTenant       bool   `key:"NAMESPACE_PER_TENANT"`
+	TenantPrefix    string `key:"TENANT_NAMESPACE_PREFIX" default:"genezio-build-"`
+	TenantCPU       string `key:"TENANT_QUOTA_CPU" default:"8"`
+	TenantMemory    string `key:"TENANT_QUOTA_MEMORY" default:"16Gi"`
+	TenantPods      string `key:"TENANT_QUOTA_PODS" default:"10"`
+	TenantRole      string `key:"TENANT_CLUSTER_ROLE" default:"argo-workflow-executor"`
+	ImagePullSecret string `key:"IMAGE_PULL_SECRET" default:"regcred"`
+	// TenantPodCIDRs are the ranges of the pod IPs of the cluster, builds
+	// can only reach the pods of their own and of the shared namespaces
+	TenantPodCIDRs []string `key:"TENANT_POD_CIDRS"`
+}
+
+func (c *configStruct) validate() error {
+	var errs []error
+	if c.MaxConcurrentBuilds < 1 {
+		errs = append(errs, fmt.Errorf("MAX_CONCURRENT_BUILDS must be at least 1"))
+	}
+	if c.MaxGlobalConcurrentBuilds < 0 {
+		errs = append(errs, fmt.Errorf("MAX_GLOBAL_CONCURRENT_BUILDS must not be negative"))
+	}
+	if c.MaxQueuedBuildsPerUser < 0 {
+		errs = append(errs, fmt.Errorf("MAX_QUEUED_BUILDS_PER_USER must not be negative"))
+	}
+	if c.ArchiveCompressionLevel < -2 || c.ArchiveCompressionLevel > 9 {
+		errs = append(errs, fmt.Errorf("ARCHIVE_COMPRESSION_LEVEL must be between -2 and 9"))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("TRACING_SAMPLE_RATIO must be between 0 and 1"))
+	}
+	if c.Namespaces.PerTenant {
+		quotas := [][2]string{
+			{"K8S_TENANT_QUOTA_CPU", c.Namespaces.TenantCPU},
+			{"K8S_TENANT_QUOTA_MEMORY", c.Namespaces.TenantMemory},
+			{"K8S_TENANT_QUOTA_PODS", c.Namespaces.TenantPods},
+		}
+		for _, quota := range quotas {
+			if _, err := resource.ParseQuantity(quota[1]); err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a Kubernetes quantity: %v", quota[0], err))
+			}
+		}
+		if len(c.Namespaces.TenantPodCIDRs) == 0 {
+			errs = append(errs, fmt.Errorf("K8S_TENANT_POD_CIDRS is required with K8S_NAMESPACE_PER_TENANT"))
+		}
+		for _, cidr := range c.Namespaces.TenantPodCIDRs {
+			if ip, _, err := net.ParseCIDR(cidr); err != nil || ip.To4() == nil {
+				errs = append(errs, fmt.Errorf("K8S_TENANT_POD_CIDRS must be IPv4 CIDRs, got %q", cidr))
+			}
+		}
+	}
+	if c.RateLimit.Enabled {
+		if c.RateLimit.IPRate <= 0 || c.RateLimit.TokenRate <= 0 {
+			errs = append(errs, fmt.Errorf("RATE_LIMIT_IP_RATE and RATE_LIMIT_TOKEN_RATE must be positive"))
+		}
+		if c.RateLimit.IPBurst < 1 || c.RateLimit.TokenBurst < 1 {
+			errs = append(errs, fmt.Errorf("RATE_LIMIT_IP_BURST and RATE_LIMIT_TOKEN_BURST must be at least 1"))
+		}
+		if c.RateLimit.TrustedProxies < 0 {
+			errs = append(errs, fmt.Errorf("RATE_LIMIT_TRUSTED_PROXIES must not be negative"))
+		}
+	}
+	if c.CORS.AllowCredentials && slices.Contains(c.CORS.AllowedOrigins, "*") {
+		errs = append(errs, fmt.Errorf("CORS_ALLOWED_ORIGINS can't contain * when CORS_ALLOW_CREDENTIALS is set"))
+	}
+	if c.CORS.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("CORS_MAX_AGE must not be negative"))
+	}
+	if c.MaxArchiveSize < 0 {
+		errs = append(errs, fmt.Errorf("MAX_ARCHIVE_SIZE must not be negative"))
+	}
+	if c.MaxRequestBodySize < 1 {
+		errs = append(errs, fmt.Errorf("MAX_REQUEST_BODY_SIZE must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+var config atomic.Pointer[configStruct]
+
+// processEnv holds the variables set before the .env file was loaded, they
+// take precedence over the .env file on reload as they do on startup.
+var processEnv map[string]bool
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func loadConfigFromEnv() (*configStruct, error) {
+	cfg := &configStruct{}
+	errs := loadStructFromEnv(reflect.ValueOf(cfg).Elem(), "")
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func loadStructFromEnv(value reflect.Value, prefix string) []error {
+	var errs []error
+	for _, field := range reflect.VisibleFields(value.Type()) {
+		fieldValue := value.FieldByIndex(field.Index)
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			errs = append(errs, loadStructFromEnv(fieldValue, prefix+field.Tag.Get("prefix"))...)
+			continue
+		}
+
+		key := prefix + field.Tag.Get("key")
+		rawValue, err := lookupEnv(key, field.Tag.Get("secret") == "true")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if rawValue == nil {
+			defaultValue := field.Tag.Get("default")
+			rawValue = &defaultValue
+		}
+
+		if *rawValue == "" && field.Tag.Get("required") == "true" {
+			errs = append(errs, fmt.Errorf("%s is required", key))
+			continue
+		}
+		if err := setField(fieldValue, *rawValue); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse %s: %v", key, err))
+		}
+	}
+	return errs
+}
+
+// lookupEnv returns nil if key is not set or empty, deployments often render
+// the unset variables as empty. Secrets can also be provided as a file whose
+// path is set in <key>_FILE.
+func lookupEnv(key string, secret bool) (*string, error) {
+	if value := os.Getenv(key); value != "" {
+		return &value, nil
+	}
+
+	if !secret {
+		return nil, nil
+	}
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("Error loading .env file", err)
+		return nil, fmt.Errorf("failed to read %s_FILE: %v", key, err)
 	}
+	value := strings.TrimRight(string(content), "\r\n")
+	return &value, nil
+}
 
-	// Get array of fields for the config struct
-	config = &configStruct{}
-	res := reflect.VisibleFields(reflect.TypeOf(*config))
+func setField(field reflect.Value, rawValue string) error {
+	if field.Type() == durationType {
+		if rawValue == "" {
+			field.SetInt(0)
+			return nil
+		}
+		duration, err := time.ParseDuration(rawValue)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
 
-	for _, field := range res {
-		fieldKeyTag := field.Tag.Get("key")
-		fieldValue := os.Getenv(fieldKeyTag)
-		if fieldValue == "" {
-			fieldValue = field.Tag.Get("default")
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(rawValue)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if rawValue == "" {
+			field.SetInt(0)
+			return nil
+		}
+		value, err := strconv.ParseInt(rawValue, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(value)
+	case reflect.Float64:
+		if rawValue == "" {
+			field.SetFloat(0)
+			return nil
+		}
+		value, err := strconv.ParseFloat(rawValue, 64)
+		if err != nil {
+			return err
 		}
+		field.SetFloat(value)
+	case reflect.Bool:
+		if rawValue == "" {
+			field.SetBool(false)
+			return nil
+		}
+		value, err := strconv.ParseBool(rawValue)
+		if err != nil {
+			return err
+		}
+		field.SetBool(value)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", field.Type())
+		}
+		var values []string
+		for _, value := range strings.Split(rawValue, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// LoadConfig reads the configuration from the environment and the .env file.
+func LoadConfig() error {
+	processEnv = make(map[string]bool)
+	for _, variable := range os.Environ() {
+		key, _, _ := strings.Cut(variable, "=")
+		processEnv[key] = true
+	}
+
+	err := godotenv.Load()
+	if err != nil {
+		slog.Warn("Error loading .env file", "error", err)
+	}
 
-		reflect.ValueOf(config).Elem().FieldByName(field.Name).SetString(fieldValue)
+	cfg, err := loadConfigFromEnv()
+	if err != nil {
+		return err
 	}
+	config.Store(cfg)
+	return nil
 }
 
 func GetConfig() *configStruct {
-	if config == nil {
-		loadConfigFromEnv()
+	if config.Load() == nil {
+		if err := LoadConfig(); err != nil {
+			slog.Error("Invalid configuration", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	return config.Load()
+}
+
+// ReloadConfig re-reads the environment and the .env file and applies the
+// fields tagged with reload. Other changes require a restart and are ignored.
+func ReloadConfig() error {
+	dotenv, err := godotenv.Read()
+	if err != nil {
+		slog.Warn("Error loading .env file", "error", err)
+	}
+	for key, value := range dotenv {
+		if !processEnv[key] {
+			os.Setenv(key, value)
+		}
 	}
 
-	return config
+	fresh, err := loadConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	reloaded := *GetConfig()
+	reloadFields(reflect.ValueOf(&reloaded).Elem(), reflect.ValueOf(fresh).Elem())
+	config.Store(&reloaded)
+	return nil
+}
+
+func reloadFields(current, fresh reflect.Value) {
+	for _, field := range reflect.VisibleFields(current.Type()) {
+		currentValue := current.FieldByIndex(field.Index)
+		freshValue := fresh.FieldByIndex(field.Index)
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			reloadFields(currentValue, freshValue)
+			continue
+		}
+
+		if reflect.DeepEqual(currentValue.Interface(), freshValue.Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") != "true" {
+			slog.Warn("Ignoring configuration change, a restart is required to apply it", "field", field.Name)
+			continue
+		}
+		slog.Info("Reloaded configuration", "field", field.Name)
+		currentValue.Set(freshValue)
+	}
+}
+
+// WatchConfigReload reloads the configuration every time the process receives SIGHUP.
+func WatchConfigReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := ReloadConfig(); err != nil {
+				slog.Error("Failed to reload configuration, keeping the current one", "error", err)
+			}
+		}
+	}()
 }
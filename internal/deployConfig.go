@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"sigs.k8s.io/yaml"
+)
+
+// SupportedRegions are the regions genezio projects can be deployed to.
+var SupportedRegions = []string{
+	"us-east-1",
+	"us-east-2",
+	"us-west-1",
+	"us-west-2",
+	"ca-central-1",
+	"sa-east-1",
+	"eu-central-1",
+	"eu-west-1",
+	"eu-west-2",
+	"eu-west-3",
+	"eu-north-1",
+	"ap-south-1",
+	"ap-northeast-1",
+	"ap-northeast-2",
+	"ap-northeast-3",
+	"ap-southeast-1",
+	"ap-southeast-2",
+}
+
+const (
+	// CredentialsStatic uses an access key pair from the configuration.
+	CredentialsStatic = "static"
+	// CredentialsIAMRole uses the role of the machine running the service,
+	// optionally assuming RoleARN on top of it.
+	CredentialsIAMRole = "iam-role"
+	// CredentialsWebIdentity exchanges a projected service account token for RoleARN.
+	CredentialsWebIdentity = "web-identity"
+)
+
+var AvailableCredentialSources = []string{
+	CredentialsStatic,
+	CredentialsIAMRole,
+	CredentialsWebIdentity,
+}
+
+type CredentialsConfig struct {
+	Source               string `json:"source"`
+	AccessKeyID          string `json:"accessKeyId,omitempty"`
+	SecretAccessKey      string `json:"secretAccessKey,omitempty"`
+	RoleARN              string `json:"roleArn,omitempty"`
+	WebIdentityTokenFile string `json:"webIdentityTokenFile,omitempty"`
+}
+
+type ClusterConfig struct {
+	// Name is the EKS cluster name, it defaults to the key in DeployConfig.Clusters
+	Name        string            `json:"name,omitempty"`
+	AWSRegion   string            `json:"awsRegion"`
+	Credentials CredentialsConfig `json:"credentials"`
+	// Capacity is the number of builds the cluster runs at once, 0 for no limit
+	Capacity int `json:"capacity,omitempty"`
+	// Regions are the deploy regions the cluster accepts builds for, on top
+	// of the regions that reference it as their cluster
+	Regions []string `json:"regions,omitempty"`
+}
+
+type RegionConfig struct {
+	Bucket      string            `json:"bucket"`
+	Credentials CredentialsConfig `json:"credentials"`
+	// Cluster references an entry of DeployConfig.Clusters
+	Cluster string `json:"cluster"`
+}
+
+// DeployConfig maps every deploy region to the resources used for it.
+// It is read from CONFIG_FILE (YAML or JSON) or, when that is unset, derived
+// from the environment variables.
+type DeployConfig struct {
+	DefaultCluster string                   `json:"defaultCluster"`
+	Clusters       map[string]ClusterConfig `json:"clusters"`
+	Regions        map[string]RegionConfig  `json:"regions"`
+	// Tiers maps lower case subscription plans to their limits
+	Tiers map[string]TierConfig `json:"tiers,omitempty"`
+	// Builder lists the builder images and sizes deploys can ask for
+	Builder BuilderConfig `json:"builder,omitempty"`
+	// Concurrency sets what happens to deploys of a project stage that is
+	// already being built
+	Concurrency ConcurrencyConfig `json:"concurrency,omitempty"`
+}
+
+var deployConfig *DeployConfig
+
+// LoadDeployConfig reads and validates the deploy configuration.
+func LoadDeployConfig() error {
+	var cfg *DeployConfig
+	var err error
+	if configFile := GetConfig().ConfigFile; configFile != "" {
+		cfg, err = deployConfigFromFile(configFile)
+	} else {
+		cfg = deployConfigFromEnv()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	deployConfig = cfg
+	return nil
+}
+
+func GetDeployConfig() *DeployConfig {
+	if deployConfig == nil {
+		if err := LoadDeployConfig(); err != nil {
+			slog.Error("Invalid deploy configuration", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	return deployConfig
+}
+
+func deployConfigFromFile(path string) (*DeployConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	cfg := &DeployConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	for name, cluster := range cfg.Clusters {
+		if cluster.Name == "" {
+			cluster.Name = name
+			cfg.Clusters[name] = cluster
+		}
+	}
+	if cfg.DefaultCluster == "" && len(cfg.Clusters) == 1 {
+		cfg.DefaultCluster = maps.Keys(cfg.Clusters)[0]
+	}
+	if _, ok := cfg.Tiers[DefaultTierName]; !ok {
+		if cfg.Tiers == nil {
+			cfg.Tiers = make(map[string]TierConfig)
+		}
+		cfg.Tiers[DefaultTierName] = envTier()
+	}
+	return cfg, nil
+}
+
+func deployConfigFromEnv() *DeployConfig {
+	config := GetConfig()
+	regions := SupportedRegions
+	if len(config.DeployRegions) > 0 {
+		regions = config.DeployRegions
+	}
+
+	cfg := &DeployConfig{
+		DefaultCluster: config.BuildClusterName,
+		Clusters: map[string]ClusterConfig{
+			config.BuildClusterName: {
+				Name:        config.BuildClusterName,
+				AWSRegion:   config.BuildClusterRegion,
+				Credentials: envCredentials(config.AccessKeyCluster, config.AccessKeySecretCluster),
+				Capacity:    config.BuildClusterCapacity,
+			},
+		},
+		Regions: make(map[string]RegionConfig),
+		Tiers: map[string]TierConfig{
+			DefaultTierName: envTier(),
+		},
+	}
+	for _, region := range regions {
+		cfg.Regions[region] = RegionConfig{
+			Bucket:      fmt.Sprintf("%s-%s", config.BucketBaseName, region),
+			Credentials: envCredentials(config.AWSAccessKeyID, config.AWSSecretAccessKey),
+			Cluster:     config.BuildClusterName,
+		}
+	}
+
+	return cfg
+}
+
+// envTier only limits the concurrent builds, to MAX_CONCURRENT_BUILDS which
+// is read when the limit is checked, so reloading it applies right away.
+func envTier() TierConfig {
+	return TierConfig{}
+}
+
+// envCredentials uses the given key pair if set and the machine role otherwise.
+func envCredentials(accessKeyID, secretAccessKey string) CredentialsConfig {
+	if accessKeyID == "" && secretAccessKey == "" {
+		return CredentialsConfig{Source: CredentialsIAMRole}
+	}
+	return CredentialsConfig{
+		Source:          CredentialsStatic,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+	}
+}
+
+func (c CredentialsConfig) Validate() error {
+	switch c.Source {
+	case CredentialsStatic:
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return fmt.Errorf("static credentials require accessKeyId and secretAccessKey")
+		}
+	case CredentialsIAMRole:
+	case CredentialsWebIdentity:
+		if c.RoleARN == "" && os.Getenv("AWS_ROLE_ARN") == "" {
+			return fmt.Errorf("web-identity credentials require roleArn")
+		}
+	default:
+		return fmt.Errorf("unknown credentials source %q, one of %v", c.Source, AvailableCredentialSources)
+	}
+	return nil
+}
+
+// Validate checks that every region is supported and fully configured.
+func (c *DeployConfig) Validate() error {
+	if len(c.Regions) == 0 {
+		return fmt.Errorf("no deploy regions configured")
+	}
+
+	var unsupported []string
+	for region := range c.Regions {
+		if !slices.Contains(SupportedRegions, region) {
+			unsupported = append(unsupported, region)
+		}
+	}
+	if len(unsupported) > 0 {
+		slices.Sort(unsupported)
+		return fmt.Errorf("unsupported regions %v, supported regions are %v", unsupported, SupportedRegions)
+	}
+
+	for name, cluster := range c.Clusters {
+		if cluster.AWSRegion == "" {
+			return fmt.Errorf("cluster %s: awsRegion is required", name)
+		}
+		if cluster.Capacity < 0 {
+			return fmt.Errorf("cluster %s: capacity must not be negative", name)
+		}
+		for _, region := range cluster.Regions {
+			if _, ok := c.Regions[region]; !ok {
+				return fmt.Errorf("cluster %s: region %s is not configured", name, region)
+			}
+		}
+		if err := cluster.Credentials.Validate(); err != nil {
+			return fmt.Errorf("cluster %s: %v", name, err)
+		}
+	}
+	if _, ok := c.Clusters[c.DefaultCluster]; !ok {
+		return fmt.Errorf("default cluster %q is not configured", c.DefaultCluster)
+	}
+
+	for name, tier := range c.Tiers {
+		if name != strings.ToLower(name) {
+			return fmt.Errorf("tier %s: names must be lower case", name)
+		}
+		if err := tier.Validate(); err != nil {
+			return fmt.Errorf("tier %s: %v", name, err)
+		}
+		for _, class := range tier.Sizes {
+			if _, ok := c.Builder.Sizes[class]; !ok {
+				return fmt.Errorf("tier %s: size %s is not configured", name, class)
+			}
+		}
+	}
+	if err := c.Builder.Validate(); err != nil {
+		return fmt.Errorf("builder: %v", err)
+	}
+	if err := c.Concurrency.Validate(); err != nil {
+		return fmt.Errorf("concurrency: %v", err)
+	}
+
+	for region, regionConfig := range c.Regions {
+		if regionConfig.Bucket == "" {
+			return fmt.Errorf("region %s: bucket is required", region)
+		}
+		if err := regionConfig.Credentials.Validate(); err != nil {
+			return fmt.Errorf("region %s: %v", region, err)
+		}
+		if _, ok := c.Clusters[regionConfig.Cluster]; !ok {
+			return fmt.Errorf("region %s: cluster %q is not configured", region, regionConfig.Cluster)
+		}
+	}
+
+	return nil
+}
+
+func (c *DeployConfig) Region(region string) (RegionConfig, error) {
+	regionConfig, ok := c.Regions[region]
+	if !ok {
+		return RegionConfig{}, fmt.Errorf("region %s is not configured", region)
+	}
+	return regionConfig, nil
+}
+
+// RegionNames returns the configured deploy regions in a stable order.
+func (c *DeployConfig) RegionNames() []string {
+	names := maps.Keys(c.Regions)
+	slices.Sort(names)
+	return names
+}
+
+// ClusterNames returns the configured build clusters in a stable order.
+func (c *DeployConfig) ClusterNames() []string {
+	names := maps.Keys(c.Clusters)
+	slices.Sort(names)
+	return names
+}
+
+// ClustersForRegion returns the clusters that accept builds for region, the
+// cluster configured for the region first.
+func (c *DeployConfig) ClustersForRegion(region string) []string {
+	regionConfig, ok := c.Regions[region]
+	if !ok {
+		return nil
+	}
+
+	clusters := []string{regionConfig.Cluster}
+	for _, name := range c.ClusterNames() {
+		if name != regionConfig.Cluster && slices.Contains(c.Clusters[name].Regions, region) {
+			clusters = append(clusters, name)
+		}
+	}
+	return clusters
+}
+
+// ValidateRegion checks that deploys can be accepted for region.
+func (c *DeployConfig) ValidateRegion(region string) error {
+	if region == "" {
+		return fmt.Errorf("region is required")
+	}
+	if _, ok := c.Regions[region]; !ok {
+		return fmt.Errorf("region %q is not supported, one of %v", region, c.RegionNames())
+	}
+	return nil
+}
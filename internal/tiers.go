@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DefaultTierName is the tier of users whose plan has no tier configured.
+const DefaultTierName = "default"
+
+// TierConfig holds the limits applied to the builds of a subscription plan.
+type TierConfig struct {
+	// MaxConcurrentBuilds is the number of builds of a user running at once,
+	// 0 for MAX_CONCURRENT_BUILDS
+	MaxConcurrentBuilds int `json:"maxConcurrentBuilds,omitempty"`
+	// MaxDailyBuilds is the number of builds a user can start in 24 hours,
+	// 0 for no limit
+	MaxDailyBuilds int `json:"maxDailyBuilds,omitempty"`
+	// BuildTimeoutSeconds stops builds running for longer, 0 for no limit
+	BuildTimeoutSeconds int64 `json:"buildTimeoutSeconds,omitempty"`
+	// CPU and Memory are the requests of the builder container, the values of
+	// the workflow template are kept when empty
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+	// Sizes are the builder size classes the tier can ask for, builds of a
+	// tier without sizes keep the CPU and Memory above
+	Sizes []string `json:"sizes,omitempty"`
+	// MaxDisk caps the builder disk below the one of the builder config
+	MaxDisk string `json:"maxDisk,omitempty"`
+}
+
+func (t TierConfig) Validate() error {
+	if t.MaxConcurrentBuilds < 0 {
+		return fmt.Errorf("maxConcurrentBuilds must not be negative")
+	}
+	if t.MaxDailyBuilds < 0 {
+		return fmt.Errorf("maxDailyBuilds must not be negative")
+	}
+	if t.BuildTimeoutSeconds < 0 {
+		return fmt.Errorf("buildTimeoutSeconds must not be negative")
+	}
+	return validateQuantities(map[string]string{"cpu": t.CPU, "memory": t.Memory, "maxDisk": t.MaxDisk}, false)
+}
+
+// AllowsSize reports whether builds of the tier can use the size class. Size
+// classes must be listed, so a tier that was left out of the config can't ask
+// for the largest one.
+func (t TierConfig) AllowsSize(class string) bool {
+	return slices.Contains(t.Sizes, class)
+}
+
+// Tier returns the tier of a subscription plan, plans are matched ignoring
+// case and fall back to the default tier.
+func (c *DeployConfig) Tier(plan string) (string, TierConfig) {
+	name := strings.ToLower(plan)
+	if tier, ok := c.Tiers[name]; ok {
+		return name, tier
+	}
+	return DefaultTierName, c.Tiers[DefaultTierName]
+}
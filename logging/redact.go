@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Attributes whose key contains one of these are never logged.
+var sensitiveKeys = []string{
+	"token",
+	"authorization",
+	"secret",
+	"password",
+	"credential",
+}
+
+var (
+	// Presigned URLs grant access on their own, keep the location but drop the signature
+	presignedURLPattern = regexp.MustCompile(`(https?://[^\s"'?]+)\?[^\s"']*(?:X-Amz-Signature|X-Amz-Credential|Signature=)[^\s"']*`)
+	bearerPattern       = regexp.MustCompile(`(?i)(bearer\s+)[^\s"']+`)
+)
+
+// RedactString removes presigned URL signatures and bearer tokens from s.
+func RedactString(s string) string {
+	s = presignedURLPattern.ReplaceAllString(s, "$1?"+redacted)
+	return bearerPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitiveKey := range sensitiveKeys {
+		if strings.Contains(key, sensitiveKey) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactString(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactString(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "build_machine"
+
+const (
+	OutcomeAccepted = "accepted"
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+	OutcomeReplayed = "replayed"
+)
+
+var (
+	DeployRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deploy_requests_total",
+		Help:      "Deploy requests by deploy type and outcome.",
+	}, []string{"type", "outcome"})
+
+	BuildStatusDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "build_status_duration_seconds",
+		Help:      "Time builds spent in each status before moving to the next one.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"engine", "status"})
+
+	BuildDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "build_duration_seconds",
+		Help:      "End-to-end build duration by final status.",
+		Buckets:   prometheus.ExponentialBuckets(10, 1.5, 12),
+	}, []string{"engine", "status"})
+
+	StatusPollErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "status_poll_errors_total",
+		Help:      "Failed attempts to read the build status from the builder pod.",
+	}, []string{"type"})
+
+	ArchiveUploadSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "archive_upload_size_bytes",
+		Help:      "Size of the source archives uploaded to the artifact store.",
+		Buckets:   prometheus.ExponentialBuckets(64*1024, 4, 8),
+	}, []string{"store"})
+
+	ArchiveUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "archive_upload_duration_seconds",
+		Help:      "Time spent archiving and uploading source code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"store"})
+
+	ConcurrentBuilds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "concurrent_builds",
+		Help:      "Builds currently in progress by engine.",
+	}, []string{"engine"})
+
+	QueuedBuilds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queued_builds",
+		Help:      "Builds waiting in the queue by engine.",
+	}, []string{"engine"})
+
+	QueueWaitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_duration_seconds",
+		Help:      "Time builds spent queued before being dispatched to a cluster.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+	})
+
+	ClusterBuilds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_builds",
+		Help:      "Build slots reserved on each build cluster.",
+	}, []string{"cluster"})
+
+	RateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected by the rate limiter by the limit they exceeded.",
+	}, []string{"scope"})
+)
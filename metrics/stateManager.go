@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	statemanager "build-machine/state_manager"
+	"time"
+)
+
+// instrumentedStateManager records build metrics from the state transitions
+// flowing through the wrapped StateManager.
+type instrumentedStateManager struct {
+	statemanager.StateManager
+}
+
+func InstrumentStateManager(stateManager statemanager.StateManager) statemanager.StateManager {
+	return &instrumentedStateManager{
+		StateManager: stateManager,
+	}
+}
+
+// CreateState implements StateManager.
+func (i *instrumentedStateManager) CreateState(jobId, token string, engine string, quota statemanager.BuildQuota) error {
+	if err := i.StateManager.CreateState(jobId, token, engine, quota); err != nil {
+		return err
+	}
+	QueuedBuilds.WithLabelValues(engine).Inc()
+	return nil
+}
+
+// DeleteState implements StateManager.
+func (i *instrumentedStateManager) DeleteState(jobId string) error {
+	previous, err := i.StateManager.GetState(jobId)
+	if err != nil {
+		return i.StateManager.DeleteState(jobId)
+	}
+	if err := i.StateManager.DeleteState(jobId); err != nil {
+		return err
+	}
+	if previous.BuildStatus == statemanager.StatusQueued {
+		QueuedBuilds.WithLabelValues(previous.BuildEngine).Dec()
+	}
+	return nil
+}
+
+// UpdateState implements StateManager.
+func (i *instrumentedStateManager) UpdateState(jobId, reason string, state statemanager.BuildStatus) error {
+	previous, err := i.StateManager.GetState(jobId)
+	if err != nil {
+		return i.StateManager.UpdateState(jobId, reason, state)
+	}
+	if err := i.StateManager.UpdateState(jobId, reason, state); err != nil {
+		return err
+	}
+
+	engine := previous.BuildEngine
+	BuildStatusDuration.WithLabelValues(engine, string(previous.BuildStatus)).Observe(time.Since(previous.Timestamp).Seconds())
+	if previous.BuildStatus == statemanager.StatusQueued && state != statemanager.StatusQueued {
+		QueuedBuilds.WithLabelValues(engine).Dec()
+		if !state.IsTerminal() {
+			ConcurrentBuilds.WithLabelValues(engine).Inc()
+			QueueWaitDuration.Observe(time.Since(previous.CreatedAt).Seconds())
+		}
+	} else if state.IsTerminal() && !previous.BuildStatus.IsTerminal() {
+		ConcurrentBuilds.WithLabelValues(engine).Dec()
+	}
+	if state.IsTerminal() && !previous.BuildStatus.IsTerminal() {
+		BuildDuration.WithLabelValues(engine, string(state)).Observe(time.Since(previous.CreatedAt).Seconds())
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package queue
+
+import (
+	"build-machine/internal"
+	"build-machine/logging"
+	"build-machine/service"
+	statemanager "build-machine/state_manager"
+	"build-machine/workflows"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// retryInterval is how often the queue retries dispatching when the clusters
+// had no capacity left.
+const retryInterval = 5 * time.Second
+
+// ErrQueueFull is returned when a user already has the maximum number of
+// builds waiting.
+var ErrQueueFull = errors.New("too many builds are queued")
+
+// Job is a build waiting for a slot.
+type Job struct {
+	ID       string
+	Token    string
+	Workflow workflows.Workflow
+	// Region is the deploy region, it picks the clusters the build can run on
+	Region string
+	// MaxConcurrentBuilds is the limit of the user's tier, the newest queued
+	// build of a user sets it for all of them, 0 for MAX_CONCURRENT_BUILDS
+	MaxConcurrentBuilds int
+	// Ctx carries the logger and trace of the deploy request
+	Ctx context.Context
+}
+
+// BuildQueue holds the accepted builds until they can be started. Builds are
+// dispatched round robin between users, each user runs at most the
+// concurrent builds of their tier and everybody together at most
+// MAX_GLOBAL_CONCURRENT_BUILDS. Builds of the same project stage run one
+// after the other.
+type BuildQueue struct {
+	mu sync.Mutex
+	// queued holds the waiting builds of every user in arrival order
+	queued map[string][]*Job
+	// users are the users with queued builds in round robin order, next is
+	// the index of the user whose turn it is
+	users   []string
+	next    int
+	running map[string]int
+	total   int
+
+	stateManager statemanager.StateManager
+	wake         chan struct{}
+}
+
+func NewBuildQueue(stateManager statemanager.StateManager) *BuildQueue {
+	return &BuildQueue{
+		queued:       make(map[string][]*Job),
+		running:      make(map[string]int),
+		stateManager: stateManager,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Accepts checks whether token may queue another build.
+func (q *BuildQueue) Accepts(token string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.accepts(token)
+}
+
+func (q *BuildQueue) accepts(token string) error {
+	maxQueued := internal.GetConfig().MaxQueuedBuildsPerUser
+	if maxQueued > 0 && len(q.queued[token]) >= maxQueued {
+		return fmt.Errorf("%w, at most %d builds can wait at once", ErrQueueFull, maxQueued)
+	}
+	return nil
+}
+
+// Enqueue adds job to the end of its user's queue and returns its position.
+func (q *BuildQueue) Enqueue(job *Job) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.accepts(job.Token); err != nil {
+		return 0, err
+	}
+
+	if _, ok := q.queued[job.Token]; !ok {
+		q.users = append(q.users, job.Token)
+	}
+	q.queued[job.Token] = append(q.queued[job.Token], job)
+	q.signal()
+	return q.position(job.ID), nil
+}
+
+// Position returns the 1-based position of the build jobId among the builds
+// still waiting, assuming they are dispatched in round robin order.
+func (q *BuildQueue) Position(jobId string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	position := q.position(jobId)
+	return position, position > 0
+}
+
+func (q *BuildQueue) position(jobId string) int {
+	position := 0
+	for round := 0; ; round++ {
+		remaining := false
+		for i := range q.users {
+			jobs := q.queued[q.users[(q.next+i)%len(q.users)]]
+			if round >= len(jobs) {
+				continue
+			}
+			remaining = true
+			position++
+			if jobs[round].ID == jobId {
+				return position
+			}
+		}
+		if !remaining {
+			return 0
+		}
+	}
+}
+
+// Remove drops the build jobId from the queue, it returns false if the build
+// isn't waiting anymore.
+func (q *BuildQueue) Remove(jobId string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for token, jobs := range q.queued {
+		for i, job := range jobs {
+			if job.ID == jobId {
+				q.queued[token] = append(jobs[:i:i], jobs[i+1:]...)
+				q.dropUserIfIdle(token)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run dispatches the queued builds until ctx is done.
+func (q *BuildQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		q.dispatch()
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch starts builds until the limits are reached or the clusters of
+// every region with queued builds are full.
+func (q *BuildQueue) dispatch() {
+	// Regions whose clusters had no capacity left, their builds wait for the
+	// next pass
+	exhausted := make(map[string]bool)
+	for {
+		job := q.take(exhausted)
+		if job == nil {
+			return
+		}
+
+		logger := logging.FromContext(job.Ctx)
+		err := job.Workflow.Submit(job.Ctx, job.ID, func(err error) {
+			if err != nil {
+				q.abandon(job, err)
+			}
+			q.finish(job.Token)
+		})
+		if errors.Is(err, service.ErrNoClusterCapacity) {
+			// Wait for a running build to finish, or for the next retry
+			logger.Info("No cluster capacity, keeping the build queued", "error", err)
+			exhausted[job.Region] = true
+			q.requeue(job)
+			continue
+		}
+		if err != nil {
+			logger.Error("Failed to submit build", "error", err)
+			q.stateManager.UpdateState(job.ID, err.Error(), statemanager.StatusFailed)
+			q.finish(job.Token)
+			continue
+		}
+		logger.Info("Build dispatched")
+	}
+}
+
+// take pops the next build allowed to start outside of the exhausted regions
+// and reserves its slot.
+func (q *BuildQueue) take(exhausted map[string]bool) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	config := internal.GetConfig()
+	if config.MaxGlobalConcurrentBuilds > 0 && q.total >= config.MaxGlobalConcurrentBuilds {
+		return nil
+	}
+
+	for i := range q.users {
+		index := (q.next + i) % len(q.users)
+		token := q.users[index]
+		jobs := q.queued[token]
+		if len(jobs) == 0 || q.running[token] >= maxConcurrentBuilds(jobs[len(jobs)-1]) {
+			continue
+		}
+		next := slices.IndexFunc(jobs, func(job *Job) bool {
+			return !exhausted[job.Region] && q.startable(job)
+		})
+		if next < 0 {
+			continue
+		}
+
+		job := jobs[next]
+		q.queued[token] = append(jobs[:next:next], jobs[next+1:]...)
+		q.running[token]++
+		q.total++
+		// The next build goes to the following user
+		q.next = index + 1
+		q.dropUserIfIdle(token)
+		return job
+	}
+	return nil
+}
+
+// startable reports whether no other build of the project stage of job is
+// in progress. Queued builds of the project stage are ahead of job in the
+// queue of its user.
+func (q *BuildQueue) startable(job *Job) bool {
+	state, err := q.stateManager.GetState(job.ID)
+	if err != nil || state.Project == (statemanager.ProjectStage{}) {
+		return true
+	}
+	for _, jobId := range q.stateManager.UnfinishedBuilds(state.Project) {
+		other, err := q.stateManager.GetState(jobId)
+		if err == nil && jobId != job.ID && other.BuildStatus != statemanager.StatusQueued {
+			return false
+		}
+	}
+	return true
+}
+
+// maxConcurrentBuilds returns the concurrency limit of the user of job.
+func maxConcurrentBuilds(job *Job) int {
+	if job.MaxConcurrentBuilds > 0 {
+		return job.MaxConcurrentBuilds
+	}
+	return internal.GetConfig().MaxConcurrentBuilds
+}
+
+// requeue puts back a build that could not be started at the head of its
+// user's queue and releases its slot.
+func (q *BuildQueue) requeue(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.queued[job.Token]; !ok {
+		q.users = append(q.users, job.Token)
+	}
+	q.queued[job.Token] = append([]*Job{job}, q.queued[job.Token]...)
+	q.running[job.Token]--
+	q.total--
+}
+
+// abandon fails the build job once its status can't be followed anymore, so
+// it doesn't hold its project stage and its user's slots forever. The watcher
+// stopped its workflow before giving up.
+func (q *BuildQueue) abandon(job *Job, err error) {
+	if state, stateErr := q.stateManager.GetState(job.ID); stateErr == nil && state.BuildStatus.IsTerminal() {
+		return
+	}
+	logging.FromContext(job.Ctx).Error("Lost track of the build", "error", err)
+	q.stateManager.UpdateState(job.ID, "Lost track of the build: "+err.Error(), statemanager.StatusFailed)
+}
+
+// finish releases the slot of a build of token.
+func (q *BuildQueue) finish(token string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[token]--
+	q.total--
+	q.dropUserIfIdle(token)
+	q.signal()
+}
+
+// dropUserIfIdle takes users without queued builds out of the round robin
+// and forgets the ones without running builds either.
+func (q *BuildQueue) dropUserIfIdle(token string) {
+	if q.running[token] <= 0 {
+		delete(q.running, token)
+	}
+	jobs, ok := q.queued[token]
+	if !ok || len(jobs) > 0 {
+		return
+	}
+	delete(q.queued, token)
+
+	for i, user := range q.users {
+		if user == token {
+			q.users = append(q.users[:i], q.users[i+1:]...)
+			if i < q.next {
+				q.next--
+			}
+			break
+		}
+	}
+	if len(q.users) == 0 {
+		q.next = 0
+	} else {
+		q.next %= len(q.users)
+	}
+}
+
+func (q *BuildQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
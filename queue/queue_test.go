@@ -0,0 +1,250 @@
+package queue
+
+import (
+	"build-machine/internal"
+	"build-machine/service"
+	statemanager "build-machine/state_manager"
+	"build-machine/workflows"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeWorkflow starts builds without a cluster, done is kept so the tests can
+// end the build.
+type fakeWorkflow struct {
+	stateManager statemanager.StateManager
+	project      statemanager.ProjectStage
+	// submitErr is returned by Submit instead of starting the build
+	submitErr error
+	// started collects the ids of the builds started by the tests
+	started *[]string
+	done    func(err error)
+}
+
+func (f *fakeWorkflow) Prepare(ctx context.Context, jobId string) error { return nil }
+
+func (f *fakeWorkflow) Submit(ctx context.Context, jobId string, done func(err error)) error {
+	if f.submitErr != nil {
+		return f.submitErr
+	}
+	f.done = done
+	if f.started != nil {
+		*f.started = append(*f.started, jobId)
+	}
+	return f.stateManager.UpdateState(jobId, "Scheduled", statemanager.StatusPending)
+}
+
+func (f *fakeWorkflow) GetState() (workflows.WorkflowReport, error) {
+	return workflows.WorkflowReport{}, nil
+}
+
+func (f *fakeWorkflow) Validate(ctx context.Context, args json.RawMessage) error { return nil }
+
+func (f *fakeWorkflow) AssignStateManager(state statemanager.StateManager) {}
+
+func (f *fakeWorkflow) AssignResources(resources workflows.BuildResources) {}
+
+func (f *fakeWorkflow) Project() statemanager.ProjectStage { return f.project }
+
+// enqueue records and queues the build jobId of project for token, with a
+// limit of maxConcurrentBuilds builds of token at once.
+func enqueue(t *testing.T, q *BuildQueue, jobId, token string, project statemanager.ProjectStage, maxConcurrentBuilds int, started *[]string) *fakeWorkflow {
+	t.Helper()
+	workflow := &fakeWorkflow{stateManager: q.stateManager, project: project, started: started}
+	if err := q.stateManager.CreateState(jobId, token, statemanager.EngineArgo, statemanager.BuildQuota{Account: project.Account}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.stateManager.SetProject(jobId, project); err != nil {
+		t.Fatal(err)
+	}
+	_, err := q.Enqueue(&Job{
+		ID:                  jobId,
+		Token:               token,
+		Workflow:            workflow,
+		Region:              project.Region,
+		MaxConcurrentBuilds: maxConcurrentBuilds,
+		Ctx:                 context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return workflow
+}
+
+func TestAbandonedBuildFreesProjectStage(t *testing.T) {
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	project := statemanager.ProjectStage{Account: "token", ProjectName: "app", Region: "us-east-1", Stage: "prod"}
+	first := enqueue(t, q, "job-1", "token", project, 5, nil)
+	second := enqueue(t, q, "job-2", "token", project, 5, nil)
+
+	q.dispatch()
+	if first.done == nil {
+		t.Fatal("first build of the project stage was not started")
+	}
+	if second.done != nil {
+		t.Fatal("second build started while the first one is in progress")
+	}
+
+	// The watcher stops following the first build before it finishes
+	first.done(errors.New("gave up polling the workflow status"))
+	state, err := q.stateManager.GetState("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.BuildStatus != statemanager.StatusFailed {
+		t.Fatalf("abandoned build is %s, want %s", state.BuildStatus, statemanager.StatusFailed)
+	}
+	if reason := state.Transitions[len(state.Transitions)-1].Reason; !strings.Contains(reason, "gave up polling") {
+		t.Errorf("transition reason = %q, want the watcher error", reason)
+	}
+	if builds := q.stateManager.GetConcurrentBuilds("token"); builds != 1 {
+		t.Errorf("concurrent builds = %d, want 1", builds)
+	}
+
+	q.dispatch()
+	if second.done == nil {
+		t.Fatal("second build didn't start once the first one was abandoned")
+	}
+}
+
+func TestProjectStageSharedByTokensOfAccount(t *testing.T) {
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	project := statemanager.ProjectStage{Account: "user", ProjectName: "app", Region: "us-east-1", Stage: "prod"}
+	first := enqueue(t, q, "job-1", "ci-token", project, 5, nil)
+	second := enqueue(t, q, "job-2", "cli-token", project, 5, nil)
+
+	q.dispatch()
+	if first.done == nil {
+		t.Fatal("first build of the project stage was not started")
+	}
+	if second.done != nil {
+		t.Fatal("build of another token of the account started while the first one is in progress")
+	}
+}
+
+// stage returns a distinct project stage of account in region.
+func stage(account, projectName, region string) statemanager.ProjectStage {
+	return statemanager.ProjectStage{Account: account, ProjectName: projectName, Region: region, Stage: "prod"}
+}
+
+func TestDispatchRoundRobin(t *testing.T) {
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	var started []string
+	enqueue(t, q, "a-1", "a", stage("a", "one", "us-east-1"), 5, &started)
+	enqueue(t, q, "a-2", "a", stage("a", "two", "us-east-1"), 5, &started)
+	enqueue(t, q, "a-3", "a", stage("a", "three", "us-east-1"), 5, &started)
+	enqueue(t, q, "b-1", "b", stage("b", "one", "us-east-1"), 5, &started)
+	enqueue(t, q, "b-2", "b", stage("b", "two", "us-east-1"), 5, &started)
+
+	if position, _ := q.Position("b-1"); position != 2 {
+		t.Errorf("position of b-1 = %d, want 2", position)
+	}
+	q.dispatch()
+	want := []string{"a-1", "b-1", "a-2", "b-2", "a-3"}
+	if !slices.Equal(started, want) {
+		t.Errorf("started %v, want %v", started, want)
+	}
+}
+
+func TestDispatchUserLimit(t *testing.T) {
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	var started []string
+	first := enqueue(t, q, "a-1", "a", stage("a", "one", "us-east-1"), 1, &started)
+	enqueue(t, q, "a-2", "a", stage("a", "two", "us-east-1"), 1, &started)
+	enqueue(t, q, "b-1", "b", stage("b", "one", "us-east-1"), 1, &started)
+
+	q.dispatch()
+	if want := []string{"a-1", "b-1"}; !slices.Equal(started, want) {
+		t.Fatalf("started %v, want %v", started, want)
+	}
+	if position, ok := q.Position("a-2"); !ok || position != 1 {
+		t.Errorf("position of a-2 = %d, want 1", position)
+	}
+
+	q.stateManager.UpdateState("a-1", "Done", statemanager.StatusSucceeded)
+	first.done(nil)
+	q.dispatch()
+	if want := []string{"a-1", "b-1", "a-2"}; !slices.Equal(started, want) {
+		t.Errorf("started %v, want %v", started, want)
+	}
+}
+
+func TestDispatchGlobalLimit(t *testing.T) {
+	t.Setenv("MAX_GLOBAL_CONCURRENT_BUILDS", "2")
+	internal.ReloadConfig()
+	t.Cleanup(func() { internal.ReloadConfig() })
+
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	var started []string
+	enqueue(t, q, "a-1", "a", stage("a", "one", "us-east-1"), 5, &started)
+	enqueue(t, q, "b-1", "b", stage("b", "one", "us-east-1"), 5, &started)
+	enqueue(t, q, "c-1", "c", stage("c", "one", "us-east-1"), 5, &started)
+
+	q.dispatch()
+	if want := []string{"a-1", "b-1"}; !slices.Equal(started, want) {
+		t.Errorf("started %v, want %v", started, want)
+	}
+}
+
+func TestDispatchSkipsRegionsWithoutCapacity(t *testing.T) {
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	var started []string
+	full := enqueue(t, q, "a-1", "a", stage("a", "one", "eu-west-1"), 5, &started)
+	full.submitErr = fmt.Errorf("%w eu-west-1", service.ErrNoClusterCapacity)
+	enqueue(t, q, "a-2", "a", stage("a", "two", "us-east-1"), 5, &started)
+	enqueue(t, q, "b-1", "b", stage("b", "one", "us-east-1"), 5, &started)
+
+	// The turn of a went to the build without capacity
+	q.dispatch()
+	if want := []string{"b-1", "a-2"}; !slices.Equal(started, want) {
+		t.Errorf("started %v, want %v", started, want)
+	}
+	if position, ok := q.Position("a-1"); !ok || position != 1 {
+		t.Errorf("position of a-1 = %d, %t, want it still queued first", position, ok)
+	}
+}
+
+func TestQueueLimitPerUser(t *testing.T) {
+	t.Setenv("MAX_QUEUED_BUILDS_PER_USER", "2")
+	internal.ReloadConfig()
+	t.Cleanup(func() { internal.ReloadConfig() })
+
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	enqueue(t, q, "a-1", "a", stage("a", "one", "us-east-1"), 5, nil)
+	enqueue(t, q, "a-2", "a", stage("a", "two", "us-east-1"), 5, nil)
+	if err := q.Accepts("a"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Accepts = %v, want %v", err, ErrQueueFull)
+	}
+	_, err := q.Enqueue(&Job{ID: "a-3", Token: "a", Workflow: &fakeWorkflow{}, Ctx: context.Background()})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Enqueue = %v, want %v", err, ErrQueueFull)
+	}
+	if err := q.Accepts("b"); err != nil {
+		t.Errorf("Accepts of another user = %v, want nil", err)
+	}
+
+	// Started builds don't wait in the queue anymore
+	q.dispatch()
+	if err := q.Accepts("a"); err != nil {
+		t.Errorf("Accepts once the builds started = %v, want nil", err)
+	}
+}
+
+func TestQueueWithoutLimitPerUser(t *testing.T) {
+	t.Setenv("MAX_QUEUED_BUILDS_PER_USER", "0")
+	internal.ReloadConfig()
+	t.Cleanup(func() { internal.ReloadConfig() })
+
+	q := NewBuildQueue(statemanager.NewLocalStateManager())
+	for i := range 3 {
+		enqueue(t, q, fmt.Sprintf("a-%d", i), "a", stage("a", fmt.Sprint(i), "us-east-1"), 1, nil)
+	}
+	if err := q.Accepts("a"); err != nil {
+		t.Errorf("Accepts = %v, want nil", err)
+	}
+}
@@ -2,21 +2,27 @@ package service
 
 import (
 	"build-machine/internal"
+	"build-machine/logging"
+	"build-machine/tracing"
 	"bytes"
 	"context"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os/user"
 	"path/filepath"
+	"sync"
 	"time"
 
 	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
 	wfclientset "github.com/argoproj/argo-workflows/v3/pkg/client/clientset/versioned"
 	"github.com/argoproj/argo-workflows/v3/pkg/client/clientset/versioned/typed/workflow/v1alpha1"
+	"go.opentelemetry.io/otel/attribute"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -25,57 +31,148 @@ import (
 )
 
 type ArgoService struct {
-	wfClient v1alpha1.WorkflowInterface
+	wfClient v1alpha1.ArgoprojV1alpha1Interface
 	k8Client *kubernetes.Clientset
 	config   *rest.Config
+	// namespace holds the builds, or the resources shared with the tenant
+	// namespaces in per tenant mode
+	namespace string
+	// tenantNamespaces caches the tenant namespaces known to be set up
+	tenantNamespaces sync.Map
 }
 
-func NewArgoService() *ArgoService {
-	// get current user to determine home directory
-	usr, err := user.Current()
-	checkErr(err)
-	kubeconfigDir := filepath.Join(usr.HomeDir, ".kube", "config")
-	processENV := internal.GetConfig().Env
-	var wfClient v1alpha1.WorkflowInterface
+// NewArgoServiceForCluster connects to the build cluster clusterName. In the
+// local environment the current context of the kubeconfig is used instead.
+func NewArgoServiceForCluster(clusterName string) (*ArgoService, error) {
 	var config *rest.Config
-	namespace := "default"
-	if processENV == "local" {
-		// get kubeconfig file location
-		var kubeconfig *string
-		if flag.Lookup("kubeconfig") == nil {
-			kubeconfig = flag.String("kubeconfig", kubeconfigDir, "(optional) absolute path to the kubeconfig file")
-		} else {
-			kubeconfigString := flag.Lookup("kubeconfig").Value.String()
-			kubeconfig = &kubeconfigString
+	if internal.GetConfig().Env == "local" {
+		kubeconfig, err := kubeconfigPath()
+		if err != nil {
+			return nil, err
 		}
-		flag.Parse()
-
 		// use the current context in kubeconfig
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
-		checkErr(err)
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig %s: %v", kubeconfig, err)
+		}
 	} else {
-		config = NewKubernetesConfig().Config
+		cluster, ok := internal.GetDeployConfig().Clusters[clusterName]
+		if !ok {
+			return nil, fmt.Errorf("cluster %q is not configured", clusterName)
+		}
+		kubernetesClient, err := NewKubernetesConfig(cluster)
+		if err != nil {
+			return nil, err
+		}
+		config = kubernetesClient.Config
+	}
+
+	argoClientSet, err := wfclientset.NewForConfig(config)
+	if err != nil {
+		return nil, err
 	}
-	wfClient = wfclientset.NewForConfigOrDie(config).ArgoprojV1alpha1().Workflows(namespace)
 	clientSet, err := kubernetes.NewForConfig(config)
-	checkErr(err)
+	if err != nil {
+		return nil, err
+	}
 	return &ArgoService{
-		wfClient: wfClient,
-		k8Client: clientSet,
-		config:   config,
+		wfClient:  argoClientSet.ArgoprojV1alpha1(),
+		k8Client:  clientSet,
+		config:    config,
+		namespace: internal.GetConfig().Namespaces.Namespace,
+	}, nil
+}
+
+// kubeconfigPath returns KUBECONFIG or the kubeconfig in the home directory.
+func kubeconfigPath() (string, error) {
+	if kubeconfig := internal.GetConfig().Kubeconfig; kubeconfig != "" {
+		return kubeconfig, nil
+	}
+	// get current user to determine home directory
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(usr.HomeDir, ".kube", "config"), nil
 }
 
-func (w *ArgoService) SubmitWorkflow(workflowRender wfv1.Workflow) (string, error) {
-	ctx := context.Background()
-	createdWf, err := w.wfClient.Create(ctx, &workflowRender, metav1.CreateOptions{})
+// Ping checks that the Kubernetes API server of the cluster is reachable.
+func (w *ArgoService) Ping(ctx context.Context) error {
+	return w.k8Client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// CheckWorkflowTemplates checks that every template in names is installed,
+// as ClusterWorkflowTemplates when builds run in tenant namespaces.
+func (w *ArgoService) CheckWorkflowTemplates(ctx context.Context, names []string) error {
+	var missing []string
+	for _, name := range names {
+		var err error
+		if internal.GetConfig().Namespaces.PerTenant {
+			_, err = w.wfClient.ClusterWorkflowTemplates().Get(ctx, name, metav1.GetOptions{})
+		} else {
+			_, err = w.wfClient.WorkflowTemplates(w.namespace).Get(ctx, name, metav1.GetOptions{})
+		}
+		if apierrors.IsNotFound(err) {
+			missing = append(missing, name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("workflow templates %v are not installed", missing)
+	}
+	return nil
+}
+
+// SubmitWorkflow creates the workflow in namespace and returns its name.
+func (w *ArgoService) SubmitWorkflow(ctx context.Context, namespace string, workflowRender wfv1.Workflow) (string, error) {
+	ctx, span := tracing.Start(ctx, "SubmitWorkflow", attribute.String("k8s.namespace.name", namespace))
+	createdWf, err := w.wfClient.Workflows(namespace).Create(ctx, &workflowRender, metav1.CreateOptions{})
 	if err != nil {
+		tracing.End(span, err)
 		return "", err
 	}
-	fmt.Printf("Workflow %s submitted\n", createdWf.Name)
+	span.SetAttributes(attribute.String("workflow.name", createdWf.Name))
+	span.End()
+	logging.FromContext(ctx).Info("Workflow submitted", "workflow", createdWf.Name, "namespace", namespace)
 	return createdWf.Name, nil
 }
 
+// CancelWorkflow stops the workflow jobId, its pods are terminated right away.
+func (w *ArgoService) CancelWorkflow(ctx context.Context, namespace, jobId string) error {
+	patch := []byte(`{"spec":{"shutdown":"` + string(wfv1.ShutdownStrategyTerminate) + `"}}`)
+	_, err := w.wfClient.Workflows(namespace).Patch(ctx, jobId, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// ErrPodNotFound is returned when the workflow has no pod, yet or anymore.
+var ErrPodNotFound = errors.New("no pod found")
+
+// ErrPodPending is returned while the pod of the workflow waits to be scheduled
+// or for its images.
+var ErrPodPending = errors.New("pod pending")
+
+// StreamLogs returns the output of the builder container of jobId. With
+// follow the stream stays open until the container exits.
+func (w *ArgoService) StreamLogs(ctx context.Context, namespace, jobId string, follow bool) (io.ReadCloser, error) {
+	pods, err := w.k8Client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("workflows.argoproj.io/workflow=%s", jobId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("%w for workflow %s", ErrPodNotFound, jobId)
+	}
+
+	return w.k8Client.CoreV1().Pods(namespace).GetLogs(pods.Items[0].Name, &v1.PodLogOptions{
+		Container: "main",
+		Follow:    follow,
+	}).Stream(ctx)
+}
+
 // {"status":"PENDING","message":"Starting build from git flow","time":"2024-07-17T17:35:45.988Z"}
 type ArgoPodStatus struct {
 	Status  string `json:"status"`
@@ -83,9 +180,10 @@ type ArgoPodStatus struct {
 	Time    string `json:"time"`
 }
 
-func (w *ArgoService) ReadStatusFileFromPod(jobId string) ([]ArgoPodStatus, error) {
+func (w *ArgoService) ReadStatusFileFromPod(ctx context.Context, namespace, jobId string) ([]ArgoPodStatus, error) {
+	logger := logging.FromContext(ctx)
 	time.Sleep(time.Millisecond * 500)
-	pods, err := w.k8Client.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{
+	pods, err := w.k8Client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
 		LabelSelector: fmt.Sprintf("workflows.argoproj.io/workflow=%s", jobId),
 	})
 
@@ -94,11 +192,11 @@ func (w *ArgoService) ReadStatusFileFromPod(jobId string) ([]ArgoPodStatus, erro
 	}
 
 	if len(pods.Items) == 0 {
-		return nil, fmt.Errorf("no pod found for workflow %s", jobId)
+		return nil, fmt.Errorf("%w for workflow %s", ErrPodNotFound, jobId)
 	}
 	workflowPod := pods.Items[0]
 	if workflowPod.Status.Phase == v1.PodSucceeded || workflowPod.Status.Phase == v1.PodFailed {
-		workflowRef, err := w.wfClient.Get(context.Background(), jobId, metav1.GetOptions{})
+		workflowRef, err := w.wfClient.Workflows(namespace).Get(ctx, jobId, metav1.GetOptions{})
 		if err != nil {
 			return nil, err
 		}
@@ -121,8 +219,11 @@ func (w *ArgoService) ReadStatusFileFromPod(jobId string) ([]ArgoPodStatus, erro
 			}, nil
 		}
 	}
+	if workflowPod.Status.Phase == v1.PodPending {
+		return []ArgoPodStatus{}, fmt.Errorf("%w: pod %s is not yet running", ErrPodPending, workflowPod.Name)
+	}
 	if workflowPod.Status.Phase != v1.PodRunning {
-		return []ArgoPodStatus{}, fmt.Errorf("pod %s is not yet running", workflowPod.Name)
+		return []ArgoPodStatus{}, fmt.Errorf("pod %s is %s", workflowPod.Name, workflowPod.Status.Phase)
 	}
 
 	// Extract status.json from pod
@@ -134,42 +235,33 @@ func (w *ArgoService) ReadStatusFileFromPod(jobId string) ([]ArgoPodStatus, erro
 		Stderr:    true,
 		Container: containerName,
 	}
-	req := w.k8Client.CoreV1().RESTClient().Post().Resource("pods").Name(pods.Items[0].Name).Namespace("default").SubResource("exec").VersionedParams(
+	req := w.k8Client.CoreV1().RESTClient().Post().Resource("pods").Name(pods.Items[0].Name).Namespace(namespace).SubResource("exec").VersionedParams(
 		option,
 		scheme.ParameterCodec,
 	)
 	exec, err := remotecommand.NewSPDYExecutor(w.config, "POST", req.URL())
 	if err != nil {
-		fmt.Println(err.Error())
 		return nil, err
 	}
 
 	stdout_buf := &bytes.Buffer{}
 	stderr_buf := &bytes.Buffer{}
-	err = exec.StreamWithContext(context.Background(), remotecommand.StreamOptions{
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
 		Stdout: stdout_buf,
 		Stderr: stderr_buf,
 	})
 	if err != nil {
-		fmt.Println("de aici", err.Error(), stderr_buf.String(), stdout_buf.String())
+		logger.Debug("Failed to read status file", "pod", workflowPod.Name, "error", err, "stderr", stderr_buf.String())
 		return nil, err
 	}
 	stdout_res := make([]byte, stdout_buf.Len())
 	stdout_buf.Read(stdout_res)
 	// marshal to state array
 	var states []ArgoPodStatus
-	log.Printf("stdout_res = %v", string(stdout_res))
 	err = json.Unmarshal(stdout_res, &states)
 	if err != nil {
-		fmt.Println(err.Error())
-		return nil, err
+		return nil, fmt.Errorf("failed to parse status file of pod %s: %v", workflowPod.Name, err)
 	}
 
 	return states, nil
 }
-
-func checkErr(err error) {
-	if err != nil {
-		panic(err.Error())
-	}
-}
@@ -2,10 +2,13 @@ package service
 
 import (
 	"build-machine/internal"
+	"build-machine/utils"
 	"encoding/base64"
-	"log"
-
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -14,34 +17,113 @@ import (
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 )
 
+// tokenRefreshMargin is how long before its expiration a token is replaced,
+// so requests in flight never carry an expired token.
+const tokenRefreshMargin = 2 * time.Minute
+
 type KubernetesClient struct {
 	Config *rest.Config
 }
 
-func newClientset(cluster *eks.Cluster, sess *session.Session) (*rest.Config, error) {
+// eksTokenSource generates aws-iam-authenticator tokens for a cluster and
+// caches them until they are about to expire.
+type eksTokenSource struct {
+	mu        sync.Mutex
+	generator token.Generator
+	options   *token.GetTokenOptions
+	token     token.Token
+}
+
+func newEKSTokenSource(clusterName string, sess *session.Session) (*eksTokenSource, error) {
 	gen, err := token.NewGenerator(true, false)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
-	opts := &token.GetTokenOptions{
-		ClusterID: aws.StringValue(cluster.Name),
-		Session:   sess,
+	return &eksTokenSource{
+		generator: gen,
+		options: &token.GetTokenOptions{
+			ClusterID: clusterName,
+			Session:   sess,
+		},
+	}, nil
+}
+
+// Token returns a valid token, generating a new one if needed.
+func (s *eksTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token.Token != "" && time.Until(s.token.Expiration) > tokenRefreshMargin {
+		return s.token.Token, nil
+	}
+
+	tok, err := s.generator.GetWithOptions(s.options)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token for cluster %s: %v", s.options.ClusterID, err)
+	}
+	s.token = tok
+	return tok.Token, nil
+}
+
+// Invalidate drops the cached token, the next request generates a new one.
+func (s *eksTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token.Token{}
+}
+
+// WrapTransport adds the current token to every request made with rt.
+func (s *eksTokenSource) WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return &eksTokenRoundTripper{source: s, next: rt}
+}
+
+type eksTokenRoundTripper struct {
+	source *eksTokenSource
+	next   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *eksTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+tok)
+	res, err := t.next.RoundTrip(req)
+	if err == nil && res.StatusCode == http.StatusUnauthorized {
+		// The token was rejected before its expiration, e.g. because the clock
+		// drifted, so don't reuse it
+		t.source.Invalidate()
+	}
+	return res, err
+}
+
+// WrappedRoundTripper lets client-go inspect the wrapped transport.
+func (t *eksTokenRoundTripper) WrappedRoundTripper() http.RoundTripper {
+	return t.next
+}
+
+func newClientset(cluster *eks.Cluster, sess *session.Session) (*rest.Config, error) {
+	if cluster == nil || cluster.CertificateAuthority == nil {
+		return nil, fmt.Errorf("cluster description is incomplete")
 	}
-	tok, err := gen.GetWithOptions(opts)
+	tokenSource, err := newEKSTokenSource(aws.StringValue(cluster.Name), sess)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+	// Fail early if tokens can't be generated with these credentials
+	if _, err := tokenSource.Token(); err != nil {
 		return nil, err
 	}
 	ca, err := base64.StdEncoding.DecodeString(aws.StringValue(cluster.CertificateAuthority.Data))
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
 	restConfig := rest.Config{
-		Host:        aws.StringValue(cluster.Endpoint),
-		BearerToken: tok.Token,
+		Host:          aws.StringValue(cluster.Endpoint),
+		WrapTransport: tokenSource.WrapTransport,
 		TLSClientConfig: rest.TLSClientConfig{
 			CAData: ca,
 		},
@@ -51,38 +133,45 @@ func newClientset(cluster *eks.Cluster, sess *session.Session) (*rest.Config, er
 
 }
 
-func NewKubernetesConfig() *KubernetesClient {
-	accessKeyId := internal.GetConfig().AccessKeyCluster
-	accessKeySecret := internal.GetConfig().AccessKeySecretCluster
+var (
+	kubernetesClientsMu sync.Mutex
+	kubernetesClients   = make(map[string]*KubernetesClient)
+)
 
-	clusterName := internal.GetConfig().BuildClusterName
-	sess, err := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String("us-east-1"),
-			CredentialsChainVerboseErrors: aws.Bool(true),
-			Credentials:                   credentials.NewStaticCredentials(accessKeyId, accessKeySecret, ""),
-		},
-	})
+// NewKubernetesConfig returns the client of an EKS cluster. The cluster is
+// only described once, later calls share the client and its token.
+func NewKubernetesConfig(cluster internal.ClusterConfig) (*KubernetesClient, error) {
+	kubernetesClientsMu.Lock()
+	defer kubernetesClientsMu.Unlock()
+	key := cluster.AWSRegion + "/" + cluster.Name
+	if client, ok := kubernetesClients[key]; ok {
+		return client, nil
+	}
+
+	sess, err := utils.NewAWSSession(cluster.AWSRegion, cluster.Credentials)
 	if err != nil {
-		log.Printf("Error creating session: %v\n", err)
+		return nil, fmt.Errorf("failed to create session for cluster %s: %v", cluster.Name, err)
 	}
 
 	eksSvc := eks.New(sess, &aws.Config{})
 
 	input := &eks.DescribeClusterInput{
-		Name: aws.String(clusterName),
+		Name: aws.String(cluster.Name),
 	}
 	result, err := eksSvc.DescribeCluster(input)
 	if err != nil {
-		log.Printf("Error calling DescribeCluster: %v\n", err)
+		return nil, fmt.Errorf("failed to describe cluster %s: %v", cluster.Name, err)
 	}
 
 	restConfig, err := newClientset(result.Cluster, sess)
 	if err != nil {
-		log.Printf("Error creating clientset: %v\n", err)
+		return nil, fmt.Errorf("failed to create clientset for cluster %s: %v", cluster.Name, err)
 	}
 
-	return &KubernetesClient{
+	slog.Info("Connected to build cluster", "cluster", cluster.Name, "endpoint", restConfig.Host)
+	client := &KubernetesClient{
 		Config: restConfig,
 	}
+	kubernetesClients[key] = client
+	return client, nil
 }
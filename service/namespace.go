@@ -0,0 +1,228 @@
+package service
+
+import (
+	"build-machine/internal"
+	"build-machine/logging"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tenantLabel        = "build.genez.io/tenant"
+	managedByLabel     = "app.kubernetes.io/managed-by"
+	managedByValue     = "genezio-build-machine"
+	workflowAccount    = "argo-workflow"
+	tenantResourceName = "genezio-build"
+
+	defaultContainerCPU    = "100m"
+	defaultContainerMemory = "128Mi"
+)
+
+// TenantID identifies an account without exposing its id.
+func TenantID(account string) string {
+	hash := sha256.Sum256([]byte(account))
+	return hex.EncodeToString(hash[:8])
+}
+
+// PrepareNamespace returns the namespace the builds of account run in. In per
+// tenant mode the namespace is created on first use, together with its quota,
+// network policies and the service account used by the workflows. All the
+// tokens of an account share the namespace and its quota.
+func (w *ArgoService) PrepareNamespace(ctx context.Context, account string) (string, error) {
+	config := internal.GetConfig().Namespaces
+	if !config.PerTenant {
+		return w.namespace, nil
+	}
+
+	tenant := TenantID(account)
+	namespace := config.TenantPrefix + tenant
+	if _, ok := w.tenantNamespaces.Load(namespace); ok {
+		return namespace, nil
+	}
+	if err := w.ensureTenantNamespace(ctx, namespace, tenant); err != nil {
+		return "", fmt.Errorf("failed to prepare namespace %s: %v", namespace, err)
+	}
+	w.tenantNamespaces.Store(namespace, struct{}{})
+	logging.FromContext(ctx).Info("Prepared tenant namespace", "namespace", namespace)
+	return namespace, nil
+}
+
+func (w *ArgoService) ensureTenantNamespace(ctx context.Context, namespace, tenant string) error {
+	config := internal.GetConfig().Namespaces
+	labels := map[string]string{
+		tenantLabel:    tenant,
+		managedByLabel: managedByValue,
+	}
+	meta := metav1.ObjectMeta{
+		Name:      tenantResourceName,
+		Namespace: namespace,
+		Labels:    labels,
+	}
+
+	_, err := w.k8Client.CoreV1().Namespaces().Create(ctx, &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: labels,
+		},
+	}, metav1.CreateOptions{})
+	if ignoreExists(err) != nil {
+		return err
+	}
+
+	_, err = w.k8Client.CoreV1().ResourceQuotas(namespace).Create(ctx, &v1.ResourceQuota{
+		ObjectMeta: meta,
+		Spec: v1.ResourceQuotaSpec{
+			Hard: v1.ResourceList{
+				v1.ResourceRequestsCPU:    resource.MustParse(config.TenantCPU),
+				v1.ResourceRequestsMemory: resource.MustParse(config.TenantMemory),
+				v1.ResourcePods:           resource.MustParse(config.TenantPods),
+			},
+		},
+	}, metav1.CreateOptions{})
+	if ignoreExists(err) != nil {
+		return err
+	}
+
+	// The quota rejects containers without requests, such as the Argo sidecars
+	_, err = w.k8Client.CoreV1().LimitRanges(namespace).Create(ctx, &v1.LimitRange{
+		ObjectMeta: meta,
+		Spec: v1.LimitRangeSpec{
+			Limits: []v1.LimitRangeItem{
+				{
+					Type: v1.LimitTypeContainer,
+					DefaultRequest: v1.ResourceList{
+						v1.ResourceCPU:    resource.MustParse(defaultContainerCPU),
+						v1.ResourceMemory: resource.MustParse(defaultContainerMemory),
+					},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if ignoreExists(err) != nil {
+		return err
+	}
+
+	// Builds may reach the internet but nothing may reach them, including
+	// the builds of other tenants
+	_, err = w.k8Client.NetworkingV1().NetworkPolicies(namespace).Create(ctx, &networkingv1.NetworkPolicy{
+		ObjectMeta: meta,
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		},
+	}, metav1.CreateOptions{})
+	if ignoreExists(err) != nil {
+		return err
+	}
+
+	// Nor may the builds reach other tenants. A separate policy, so it is
+	// added to the namespaces created before it existed.
+	_, err = w.k8Client.NetworkingV1().NetworkPolicies(namespace).Create(ctx, &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tenantResourceName + "-egress",
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: tenantEgressPolicy(config.TenantPodCIDRs),
+	}, metav1.CreateOptions{})
+	if ignoreExists(err) != nil {
+		return err
+	}
+
+	_, err = w.k8Client.CoreV1().ServiceAccounts(namespace).Create(ctx, &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      workflowAccount,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+	}, metav1.CreateOptions{})
+	if ignoreExists(err) != nil {
+		return err
+	}
+
+	_, err = w.k8Client.RbacV1().RoleBindings(namespace).Create(ctx, &rbacv1.RoleBinding{
+		ObjectMeta: meta,
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      workflowAccount,
+				Namespace: namespace,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     config.TenantRole,
+		},
+	}, metav1.CreateOptions{})
+	if ignoreExists(err) != nil {
+		return err
+	}
+
+	return w.copyImagePullSecret(ctx, namespace, labels)
+}
+
+// tenantEgressPolicy lets builds reach the pods of their namespace, the pods
+// of the namespaces that aren't tenants, e.g. the cluster DNS, and any address
+// outside podCIDRs.
+func tenantEgressPolicy(podCIDRs []string) networkingv1.NetworkPolicySpec {
+	return networkingv1.NetworkPolicySpec{
+		PodSelector: metav1.LabelSelector{},
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+		Egress: []networkingv1.NetworkPolicyEgressRule{
+			{
+				To: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{}},
+					{
+						NamespaceSelector: &metav1.LabelSelector{
+							MatchExpressions: []metav1.LabelSelectorRequirement{
+								{Key: tenantLabel, Operator: metav1.LabelSelectorOpDoesNotExist},
+							},
+						},
+					},
+					{IPBlock: &networkingv1.IPBlock{CIDR: "0.0.0.0/0", Except: podCIDRs}},
+				},
+			},
+		},
+	}
+}
+
+// copyImagePullSecret copies the registry credentials of the builder image
+// from the shared namespace.
+func (w *ArgoService) copyImagePullSecret(ctx context.Context, namespace string, labels map[string]string) error {
+	name := internal.GetConfig().Namespaces.ImagePullSecret
+	if name == "" {
+		return nil
+	}
+	secret, err := w.k8Client.CoreV1().Secrets(w.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to read image pull secret %s/%s: %v", w.namespace, name, err)
+	}
+
+	_, err = w.k8Client.CoreV1().Secrets(namespace).Create(ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}, metav1.CreateOptions{})
+	return ignoreExists(err)
+}
+
+func ignoreExists(err error) error {
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"build-machine/internal"
+	"build-machine/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// healthCheckInterval is how long the health of a cluster is trusted
+	healthCheckInterval = 30 * time.Second
+	healthCheckTimeout  = 3 * time.Second
+)
+
+// ErrNoClusterCapacity is returned when every healthy cluster of a region is full.
+var ErrNoClusterCapacity = errors.New("no build cluster has capacity for the region")
+
+type clusterHealth struct {
+	err       error
+	checkedAt time.Time
+}
+
+// ClusterRegistry holds one ArgoService per build cluster. Clusters are
+// connected on first use and the connection is shared by every build.
+type ClusterRegistry struct {
+	mu       sync.Mutex
+	clusters map[string]*ArgoService
+
+	// schedulingMu guards the scheduling state, it is never held while
+	// talking to a cluster
+	schedulingMu sync.Mutex
+	builds       map[string]int
+	health       map[string]clusterHealth
+}
+
+func NewClusterRegistry() *ClusterRegistry {
+	return &ClusterRegistry{
+		clusters: make(map[string]*ArgoService),
+		builds:   make(map[string]int),
+		health:   make(map[string]clusterHealth),
+	}
+}
+
+// Cluster returns the client of the cluster name, connecting to it if needed.
+// Failed connections are not cached, so they are retried on the next call.
+func (r *ClusterRegistry) Cluster(name string) (*ArgoService, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if argoService, ok := r.clusters[name]; ok {
+		return argoService, nil
+	}
+
+	argoService, err := NewArgoServiceForCluster(name)
+	if err != nil {
+		return nil, err
+	}
+	r.clusters[name] = argoService
+	return argoService, nil
+}
+
+// Default returns the client of the default build cluster.
+func (r *ClusterRegistry) Default() (*ArgoService, error) {
+	return r.Cluster(internal.GetDeployConfig().DefaultCluster)
+}
+
+// Names returns the names of the configured build clusters.
+func (r *ClusterRegistry) Names() []string {
+	return internal.GetDeployConfig().ClusterNames()
+}
+
+// Schedule picks the cluster a build for region runs on and reserves a slot
+// on it, which must be given back with Release once the build is over.
+//
+// Unhealthy and full clusters are skipped. The cluster configured for the
+// region is preferred, then the least loaded of the other clusters serving it.
+func (r *ClusterRegistry) Schedule(ctx context.Context, region string) (string, *ArgoService, error) {
+	deployConfig := internal.GetDeployConfig()
+	candidates := deployConfig.ClustersForRegion(region)
+	if len(candidates) == 0 {
+		return "", nil, fmt.Errorf("region %s is not configured", region)
+	}
+
+	primary := candidates[0]
+	var errs []error
+	for len(candidates) > 0 {
+		name := r.pick(primary, candidates)
+		if name == "" {
+			break
+		}
+		candidates = removeCandidate(candidates, name)
+
+		argoService, err := r.Cluster(name)
+		if err == nil {
+			err = r.checkHealth(ctx, name, argoService)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %v", name, err))
+			continue
+		}
+		if r.reserve(name) {
+			return name, argoService, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return "", nil, fmt.Errorf("%w: %v", ErrNoClusterCapacity, errors.Join(errs...))
+	}
+	return "", nil, ErrNoClusterCapacity
+}
+
+// pick returns the candidate with free capacity to try next, primary if it
+// is a candidate and isn't full, the least loaded one otherwise.
+func (r *ClusterRegistry) pick(primary string, candidates []string) string {
+	clusters := internal.GetDeployConfig().Clusters
+	r.schedulingMu.Lock()
+	defer r.schedulingMu.Unlock()
+
+	best := ""
+	bestLoad := 0.0
+	for _, name := range candidates {
+		capacity := clusters[name].Capacity
+		builds := r.builds[name]
+		if capacity > 0 && builds >= capacity {
+			continue
+		}
+		if name == primary {
+			return name
+		}
+
+		load := float64(builds)
+		if capacity > 0 {
+			load = float64(builds) / float64(capacity)
+		}
+		if best == "" || load < bestLoad {
+			best = name
+			bestLoad = load
+		}
+	}
+	return best
+}
+
+// reserve takes a slot on the cluster, unless another build took the last
+// one since it was picked.
+func (r *ClusterRegistry) reserve(name string) bool {
+	capacity := internal.GetDeployConfig().Clusters[name].Capacity
+	r.schedulingMu.Lock()
+	defer r.schedulingMu.Unlock()
+	if capacity > 0 && r.builds[name] >= capacity {
+		return false
+	}
+	r.builds[name]++
+	metrics.ClusterBuilds.WithLabelValues(name).Set(float64(r.builds[name]))
+	return true
+}
+
+// Release gives back the slot reserved by Schedule.
+func (r *ClusterRegistry) Release(name string) {
+	r.schedulingMu.Lock()
+	defer r.schedulingMu.Unlock()
+	if r.builds[name] > 0 {
+		r.builds[name]--
+	}
+	metrics.ClusterBuilds.WithLabelValues(name).Set(float64(r.builds[name]))
+}
+
+// Load returns the number of builds running on the cluster.
+func (r *ClusterRegistry) Load(name string) int {
+	r.schedulingMu.Lock()
+	defer r.schedulingMu.Unlock()
+	return r.builds[name]
+}
+
+// checkHealth pings the cluster, the result is reused for healthCheckInterval.
+func (r *ClusterRegistry) checkHealth(ctx context.Context, name string, argoService *ArgoService) error {
+	r.schedulingMu.Lock()
+	health, ok := r.health[name]
+	r.schedulingMu.Unlock()
+	if ok && time.Since(health.checkedAt) < healthCheckInterval {
+		return health.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	err := argoService.Ping(ctx)
+	if err != nil {
+		slog.Warn("Build cluster is unhealthy", "cluster", name, "error", err)
+	}
+
+	r.schedulingMu.Lock()
+	defer r.schedulingMu.Unlock()
+	r.health[name] = clusterHealth{err: err, checkedAt: time.Now()}
+	return err
+}
+
+func removeCandidate(candidates []string, name string) []string {
+	remaining := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate != name {
+			remaining = append(remaining, candidate)
+		}
+	}
+	return remaining
+}
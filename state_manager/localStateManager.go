@@ -1,24 +1,41 @@
 package statemanager
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 )
 
 type LocalStateManager struct {
+	mu sync.RWMutex
 	// a map that can be used for quick
 	UserConcurrentBuilds map[string]int
 	BuildMap             map[string]*State
+	ArchiveIndex         map[ArchiveKey]ArchiveRecord
+	IdempotencyKeys      map[IdempotencyKey]IdempotencyRecord
 }
 
+// idempotencyKeyTTL is how long deploys can be replayed with the same key.
+const idempotencyKeyTTL = 24 * time.Hour
+
 // CreateState implements StateManager.
-func (l *LocalStateManager) CreateState(jobId, token string, engine string) error {
-	l.UserConcurrentBuilds[token] = 0
+func (l *LocalStateManager) CreateState(jobId, token string, engine string, quota BuildQuota) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if quota.MaxBuilds > 0 && l.countBuildsSince(quota.Account, now.Add(-quota.Period)) >= quota.MaxBuilds {
+		return ErrBuildQuotaExceeded
+	}
+	l.UserConcurrentBuilds[token]++
 	l.BuildMap[jobId] = &State{
-		BuildStatus: StatusPending,
+		BuildStatus: StatusQueued,
 		BuildEngine: engine,
-		Timestamp:   time.Now(),
+		CreatedAt:   now,
+		Timestamp:   now,
 		UserToken:   token,
+		Account:     quota.Account,
 		Transitions: make([]StateTransition, 0),
 	}
 	return nil
@@ -26,24 +43,54 @@ func (l *LocalStateManager) CreateState(jobId, token string, engine string) erro
 
 // GetConcurrentBuilds implements StateManager.
 func (l *LocalStateManager) GetConcurrentBuilds(token string) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 	if _, ok := l.UserConcurrentBuilds[token]; !ok {
 		return 0
 	}
 	return l.UserConcurrentBuilds[token]
 }
 
+// countBuildsSince returns the number of builds account created after since.
+func (l *LocalStateManager) countBuildsSince(account string, since time.Time) int {
+	count := 0
+	for _, state := range l.BuildMap {
+		if state.Account == account && state.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
 // GetState implements StateManager.
 func (l *LocalStateManager) GetState(jobId string) (State, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 	if _, ok := l.BuildMap[jobId]; !ok {
-		return State{}, fmt.Errorf("job doesn't exist")
+		return State{}, ErrJobNotFound
 	}
 	return *l.BuildMap[jobId], nil
 }
 
+// ListStates implements StateManager.
+func (l *LocalStateManager) ListStates(token string) (map[string]State, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	states := make(map[string]State)
+	for jobId, state := range l.BuildMap {
+		if state.UserToken == token {
+			states[jobId] = *state
+		}
+	}
+	return states, nil
+}
+
 // UpdateState implements StateManager.
 func (l *LocalStateManager) UpdateState(jobId, reason string, state BuildStatus) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	if _, ok := l.BuildMap[jobId]; !ok {
-		return fmt.Errorf("job doesn't exist")
+		return ErrJobNotFound
 	}
 	now := time.Now()
 	oldState := *l.BuildMap[jobId]
@@ -57,17 +104,148 @@ func (l *LocalStateManager) UpdateState(jobId, reason string, state BuildStatus)
 	l.BuildMap[jobId].Transitions = append(l.BuildMap[jobId].Transitions, newTransition)
 	l.BuildMap[jobId].Timestamp = now
 
-	if state == StatusSuccess || state == StatusFailed {
+	if state.IsTerminal() && !oldState.BuildStatus.IsTerminal() {
 		l.UserConcurrentBuilds[oldState.UserToken]--
 	}
 	return nil
 }
 
+// DeleteState implements StateManager.
+func (l *LocalStateManager) DeleteState(jobId string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, ok := l.BuildMap[jobId]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if !state.BuildStatus.IsTerminal() {
+		l.UserConcurrentBuilds[state.UserToken]--
+	}
+	delete(l.BuildMap, jobId)
+	return nil
+}
+
+// SetPlacement implements StateManager.
+func (l *LocalStateManager) SetPlacement(jobId string, placement Placement) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.BuildMap[jobId]; !ok {
+		return ErrJobNotFound
+	}
+	l.BuildMap[jobId].Placement = placement
+	return nil
+}
+
+// SetArchiveInfo implements StateManager.
+func (l *LocalStateManager) SetArchiveInfo(jobId string, archive ArchiveInfo) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.BuildMap[jobId]; !ok {
+		return ErrJobNotFound
+	}
+	l.BuildMap[jobId].Archive = &archive
+	return nil
+}
+
+// SetProject implements StateManager.
+func (l *LocalStateManager) SetProject(jobId string, project ProjectStage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.BuildMap[jobId]; !ok {
+		return ErrJobNotFound
+	}
+	l.BuildMap[jobId].Project = project
+	return nil
+}
+
+// UnfinishedBuilds implements StateManager.
+func (l *LocalStateManager) UnfinishedBuilds(project ProjectStage) []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var jobIds []string
+	for jobId, state := range l.BuildMap {
+		if state.Project == project && !state.BuildStatus.IsTerminal() {
+			jobIds = append(jobIds, jobId)
+		}
+	}
+	slices.SortFunc(jobIds, func(a, b string) int {
+		return l.BuildMap[a].CreatedAt.Compare(l.BuildMap[b].CreatedAt)
+	})
+	return jobIds
+}
+
+// GetArchiveRecord implements StateManager.
+func (l *LocalStateManager) GetArchiveRecord(key ArchiveKey) (ArchiveRecord, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	record, ok := l.ArchiveIndex[key]
+	return record, ok
+}
+
+// PutArchiveRecord implements StateManager.
+func (l *LocalStateManager) PutArchiveRecord(key ArchiveKey, record ArchiveRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ArchiveIndex[key] = record
+	return nil
+}
+
+// ClaimIdempotencyKey implements StateManager.
+func (l *LocalStateManager) ClaimIdempotencyKey(key IdempotencyKey, requestHash string) (IdempotencyRecord, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for existingKey, record := range l.IdempotencyKeys {
+		if now.Sub(record.CreatedAt) > idempotencyKeyTTL {
+			delete(l.IdempotencyKeys, existingKey)
+		}
+	}
+
+	if record, ok := l.IdempotencyKeys[key]; ok {
+		return record, false, nil
+	}
+	record := IdempotencyRecord{
+		RequestHash: requestHash,
+		CreatedAt:   now,
+	}
+	l.IdempotencyKeys[key] = record
+	return record, true, nil
+}
+
+// CompleteIdempotencyKey implements StateManager.
+func (l *LocalStateManager) CompleteIdempotencyKey(key IdempotencyKey, record IdempotencyRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	claim, ok := l.IdempotencyKeys[key]
+	if !ok {
+		return fmt.Errorf("idempotency key was not claimed")
+	}
+	// Keys expire a day after they were claimed
+	record.CreatedAt = claim.CreatedAt
+	l.IdempotencyKeys[key] = record
+	return nil
+}
+
+// ReleaseIdempotencyKey implements StateManager.
+func (l *LocalStateManager) ReleaseIdempotencyKey(key IdempotencyKey) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.IdempotencyKeys, key)
+	return nil
+}
+
+// Ping implements StateManager. The state is kept in memory so it is always usable.
+func (l *LocalStateManager) Ping(ctx context.Context) error {
+	return nil
+}
+
 func NewLocalStateManager() StateManager {
 	userConcurrentBuilds := make(map[string]int)
 	buildMap := make(map[string]*State)
 	return &LocalStateManager{
 		UserConcurrentBuilds: userConcurrentBuilds,
 		BuildMap:             buildMap,
+		ArchiveIndex:         make(map[ArchiveKey]ArchiveRecord),
+		IdempotencyKeys:      make(map[IdempotencyKey]IdempotencyRecord),
 	}
 }
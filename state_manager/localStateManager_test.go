@@ -0,0 +1,44 @@
+package statemanager
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateStateQuotaPerAccount(t *testing.T) {
+	l := NewLocalStateManager()
+	quota := BuildQuota{Account: "user", MaxBuilds: 3, Period: 24 * time.Hour}
+
+	// Concurrent deploys with two tokens of the account
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token := fmt.Sprintf("token-%d", i%2)
+			err := l.CreateState(fmt.Sprintf("job-%d", i), token, EngineArgo, quota)
+			if err != nil && !errors.Is(err, ErrBuildQuotaExceeded) {
+				t.Error(err)
+			}
+			if err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if created != quota.MaxBuilds {
+		t.Errorf("created %d builds, want %d", created, quota.MaxBuilds)
+	}
+
+	other := BuildQuota{Account: "other", MaxBuilds: 3, Period: 24 * time.Hour}
+	if err := l.CreateState("other-1", "other-token", EngineArgo, other); err != nil {
+		t.Errorf("build of another account = %v, want nil", err)
+	}
+}
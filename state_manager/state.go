@@ -1,10 +1,22 @@
 package statemanager
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrJobNotFound is returned for jobs the state store doesn't know about.
+var ErrJobNotFound = errors.New("job doesn't exist")
+
+// ErrBuildQuotaExceeded is returned for builds of an account that used up its
+// BuildQuota.
+var ErrBuildQuotaExceeded = errors.New("build quota exceeded")
 
 type BuildStatus string
 
 const (
+	StatusQueued            BuildStatus = "QUEUED"
 	StatusPending           BuildStatus = "PENDING"
 	StatusAuth              BuildStatus = "AUTHENTICATING"
 	StatusPullingCode       BuildStatus = "PULLING_CODE"
@@ -13,32 +25,156 @@ const (
 	StatusDeployingBackend  BuildStatus = "DEPLOYING_BACKEND"
 	StatusDeployingFrontend BuildStatus = "DEPLOYING_FRONTEND"
 	StatusSuccess           BuildStatus = "SUCCESS"
+	StatusSucceeded         BuildStatus = "SUCCEEDED" // the builder pod itself completed
 	StatusFailed            BuildStatus = "FAILED"
+	StatusCancelled         BuildStatus = "CANCELLED"
+	StatusSuperseded        BuildStatus = "SUPERSEDED" // cancelled by a newer build of the project stage
 )
 
+// BuildStatuses lists every BuildStatus.
+var BuildStatuses = []BuildStatus{
+	StatusQueued,
+	StatusPending,
+	StatusAuth,
+	StatusPullingCode,
+	StatusInstallingDeps,
+	StatusBuilding,
+	StatusDeployingBackend,
+	StatusDeployingFrontend,
+	StatusSuccess,
+	StatusSucceeded,
+	StatusFailed,
+	StatusCancelled,
+	StatusSuperseded,
+}
+
+// IsTerminal reports whether a build in this status has finished.
+func (s BuildStatus) IsTerminal() bool {
+	return s == StatusSuccess || s == StatusSucceeded || s == StatusFailed || s == StatusCancelled || s == StatusSuperseded
+}
+
 const (
 	EngineArgo = "argo"
 	EngineAPI  = "api"
 )
 
 type StateTransition struct {
-	From           BuildStatus
-	To             BuildStatus
-	TransitionTime time.Time
-	Reason         string
+	From           BuildStatus `json:"from"`
+	To             BuildStatus `json:"to"`
+	TransitionTime time.Time   `json:"transitionTime"`
+	Reason         string      `json:"reason"`
+}
+
+// Placement records where the workflow of a build runs.
+type Placement struct {
+	Cluster   string
+	Namespace string
+}
+
+// ArchiveInfo describes the source archive uploaded for a build.
+type ArchiveInfo struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveKey identifies the source archive slot of a user's project stage.
+type ArchiveKey struct {
+	Token       string
+	ProjectName string
+	Region      string
+	Stage       string
+}
+
+// ProjectStage identifies the deploy target of a build, builds of the same
+// ProjectStage are subject to its concurrency policy.
+type ProjectStage struct {
+	// Account is the id of the user owning the project, so every token of the
+	// user deploys the same project stage. It is the token of the build when
+	// the user is unknown.
+	Account     string
+	ProjectName string
+	Region      string
+	Stage       string
+}
+
+// ArchiveRecord points at the last source archive uploaded for an ArchiveKey.
+type ArchiveRecord struct {
+	ContentHash string
+	Bucket      string
+	Key         string
+	ETag        string
+	Archive     ArchiveInfo
+	UploadedAt  time.Time
+}
+
+// IdempotencyKey identifies the deploys a user submitted with an
+// Idempotency-Key header.
+type IdempotencyKey struct {
+	Token string
+	Key   string
+}
+
+// IdempotencyRecord remembers the outcome of a deploy submitted with an
+// IdempotencyKey. JobID is empty while the first request is in progress and
+// CreatedAt is when the key was claimed.
+type IdempotencyRecord struct {
+	RequestHash   string
+	JobID         string
+	Status        string
+	QueuePosition int
+	CreatedAt     time.Time
 }
 
 type State struct {
 	BuildEngine string
 	BuildStatus BuildStatus
+	CreatedAt   time.Time
 	Timestamp   time.Time
 	UserToken   string
+	// Account is the user owning the token, see ProjectStage
+	Account     string
 	Transitions []StateTransition
+	Placement   Placement
+	Archive     *ArchiveInfo
+	Project     ProjectStage
+}
+
+// BuildQuota caps the builds an account creates in a sliding Period, deleted
+// builds don't count. A MaxBuilds of 0 is no limit.
+type BuildQuota struct {
+	Account   string
+	MaxBuilds int
+	Period    time.Duration
 }
 
 type StateManager interface {
-	CreateState(jobId, token string, engine string) error
+	// CreateState records a new build of the account of quota, it is QUEUED
+	// until it is dispatched. It fails with ErrBuildQuotaExceeded once the
+	// account used up quota.
+	CreateState(jobId, token string, engine string, quota BuildQuota) error
 	GetState(jobId string) (State, error)
+	// ListStates returns the builds of token by job id
+	ListStates(token string) (map[string]State, error)
 	UpdateState(jobId, reason string, state BuildStatus) error
+	// DeleteState forgets a build that was rejected before being queued
+	DeleteState(jobId string) error
+	SetPlacement(jobId string, placement Placement) error
+	SetArchiveInfo(jobId string, archive ArchiveInfo) error
+	SetProject(jobId string, project ProjectStage) error
+	// UnfinishedBuilds returns the builds of project that haven't finished,
+	// queued or not, oldest first
+	UnfinishedBuilds(project ProjectStage) []string
+	GetArchiveRecord(key ArchiveKey) (ArchiveRecord, bool)
+	PutArchiveRecord(key ArchiveKey, record ArchiveRecord) error
+	// ClaimIdempotencyKey records an in progress request for key unless the
+	// key is already known, in which case its record is returned with false
+	ClaimIdempotencyKey(key IdempotencyKey, requestHash string) (IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey stores the outcome of the request that claimed key
+	CompleteIdempotencyKey(key IdempotencyKey, record IdempotencyRecord) error
+	// ReleaseIdempotencyKey forgets key, so the request can be submitted again
+	ReleaseIdempotencyKey(key IdempotencyKey) error
+	// GetConcurrentBuilds returns the unfinished builds of token, queued or not
 	GetConcurrentBuilds(token string) int
+	// Ping checks that the state store can be used
+	Ping(ctx context.Context) error
 }
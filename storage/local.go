@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"build-machine/utils"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalArtifactStore keeps artifacts in a directory and serves them over HTTP
+// from the build machine itself. It is meant for development and tests, the
+// download URLs are neither signed nor expiring.
+type LocalArtifactStore struct {
+	dir       string
+	publicURL string
+}
+
+func NewLocalArtifactStore(dir, publicURL string) (*LocalArtifactStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("ARTIFACT_LOCAL_DIR is required for the %s artifact store", StoreLocal)
+	}
+	if publicURL == "" {
+		return nil, fmt.Errorf("ARTIFACT_PUBLIC_URL is required for the %s artifact store", StoreLocal)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LocalArtifactStore{
+		dir:       dir,
+		publicURL: strings.TrimRight(publicURL, "/"),
+	}, nil
+}
+
+func (l *LocalArtifactStore) path(location Location) (string, error) {
+	artifactPath := filepath.Join(l.dir, filepath.FromSlash(location.Key))
+	if !strings.HasPrefix(artifactPath, filepath.Clean(l.dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid artifact key %q", location.Key)
+	}
+	return artifactPath, nil
+}
+
+// UploadDirectory implements ArtifactStore.
+func (l *LocalArtifactStore) UploadDirectory(ctx context.Context, obj ArtifactObject, srcDir string, opts utils.ZipOptions) (Location, utils.ZipResult, error) {
+	location := Location{
+		Region: obj.Region,
+		Key:    objectKey(obj),
+	}
+	artifactPath, err := l.path(location)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(artifactPath), 0755); err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+
+	// Write next to the destination and rename, so readers never see a partial archive
+	tmpFile, err := os.CreateTemp(filepath.Dir(artifactPath), ".upload-*")
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	archive, err := utils.ZipDirectoryTo(srcDir, tmpFile, opts)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+	if err := os.Rename(tmpFile.Name(), artifactPath); err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+
+	return location, archive, nil
+}
+
+// PresignDownload implements ArtifactStore.
+func (l *LocalArtifactStore) PresignDownload(ctx context.Context, location Location) (string, error) {
+	return fmt.Sprintf("%s/artifacts/%s", l.publicURL, (&url.URL{Path: location.Key}).EscapedPath()), nil
+}
+
+// ETag implements ArtifactStore.
+func (l *LocalArtifactStore) ETag(ctx context.Context, location Location) (string, error) {
+	artifactPath, err := l.path(location)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(artifactPath)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// ServeHTTP serves stored artifacts, it is mounted under /artifacts/.
+func (l *LocalArtifactStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Directory listings would reveal every stored project
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	http.StripPrefix("/artifacts/", http.FileServer(http.Dir(l.dir))).ServeHTTP(w, r)
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"build-machine/internal"
+	"build-machine/utils"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const presignExpiry = 15 * time.Minute
+
+// s3ArtifactStore keeps artifacts in an S3 API compatible bucket.
+type s3ArtifactStore struct {
+	endpoint  string
+	pathStyle bool
+	// target resolves the bucket and credentials used for a region
+	target func(region string) (string, internal.CredentialsConfig, error)
+	// backendUpload uploads through a presigned URL issued by the genezio
+	// backend instead of writing to the bucket directly.
+	backendUpload bool
+	// backendUploads serializes the uploads of a stage through the backend,
+	// which always issues the same key for it
+	backendUploads sync.Map
+}
+
+// NewAWSArtifactStore stores artifacts in the per region genezio buckets on AWS.
+// Uploads go through the genezio backend so it can track project code.
+func NewAWSArtifactStore() ArtifactStore {
+	return &s3ArtifactStore{
+		target: func(region string) (string, internal.CredentialsConfig, error) {
+			regionConfig, err := internal.GetDeployConfig().Region(region)
+			if err != nil {
+				return "", internal.CredentialsConfig{}, err
+			}
+			return regionConfig.Bucket, regionConfig.Credentials, nil
+		},
+		backendUpload: true,
+	}
+}
+
+// NewS3CompatibleArtifactStore stores artifacts in a single bucket of any S3
+// compatible service, such as MinIO, reachable at ARTIFACT_S3_ENDPOINT.
+func NewS3CompatibleArtifactStore() (ArtifactStore, error) {
+	config := internal.GetConfig()
+	if config.Artifacts.S3Endpoint == "" {
+		return nil, fmt.Errorf("ARTIFACT_S3_ENDPOINT is required for the %s artifact store", StoreS3Compatible)
+	}
+	if config.Artifacts.S3Bucket == "" {
+		return nil, fmt.Errorf("ARTIFACT_S3_BUCKET is required for the %s artifact store", StoreS3Compatible)
+	}
+	credentials := internal.CredentialsConfig{
+		Source:          internal.CredentialsStatic,
+		AccessKeyID:     config.AWSAccessKeyID,
+		SecretAccessKey: config.AWSSecretAccessKey,
+	}
+	return &s3ArtifactStore{
+		endpoint:  config.Artifacts.S3Endpoint,
+		pathStyle: config.Artifacts.S3PathStyle,
+		target: func(region string) (string, internal.CredentialsConfig, error) {
+			return config.Artifacts.S3Bucket, credentials, nil
+		},
+	}, nil
+}
+
+func (s *s3ArtifactStore) newSession(region string) (*session.Session, error) {
+	_, credentials, err := s.target(region)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig := &aws.Config{
+		S3ForcePathStyle: aws.Bool(s.pathStyle),
+	}
+	if s.endpoint != "" {
+		awsConfig.Endpoint = aws.String(s.endpoint)
+	}
+
+	sess, err := utils.NewAWSSession(region, credentials, awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return sess, nil
+}
+
+func (s *s3ArtifactStore) newClient(region string) (*s3.S3, error) {
+	sess, err := s.newSession(region)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// UploadDirectory implements ArtifactStore.
+func (s *s3ArtifactStore) UploadDirectory(ctx context.Context, obj ArtifactObject, srcDir string, opts utils.ZipOptions) (Location, utils.ZipResult, error) {
+	if s.backendUpload {
+		return s.uploadThroughBackend(ctx, obj, srcDir, opts)
+	}
+
+	sess, err := s.newSession(obj.Region)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+	bucket, _, err := s.target(obj.Region)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+
+	location := Location{
+		Region: obj.Region,
+		Bucket: bucket,
+		Key:    objectKey(obj),
+	}
+
+	// The uploader accepts a body of unknown length, so the archive is piped
+	// into it as it is produced.
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	var archive utils.ZipResult
+	archiveErr := make(chan error, 1)
+	go func() {
+		var err error
+		archive, err = utils.ZipDirectoryTo(srcDir, pipeWriter, opts)
+		pipeWriter.CloseWithError(err)
+		archiveErr <- err
+	}()
+
+	_, err = s3manager.NewUploader(sess).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(location.Bucket),
+		Key:         aws.String(location.Key),
+		Body:        pipeReader,
+		ContentType: aws.String("application/octet-stream"),
+	})
+	if err != nil {
+		// The uploader hides the archive errors, e.g. utils.ErrArchiveTooLarge.
+		// Closing the pipe stops the archiver if the upload failed first.
+		pipeReader.Close()
+		if zipErr := <-archiveErr; zipErr != nil && !errors.Is(zipErr, io.ErrClosedPipe) {
+			return Location{}, utils.ZipResult{}, zipErr
+		}
+		return Location{}, utils.ZipResult{}, err
+	}
+	if err := <-archiveErr; err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+
+	return location, archive, nil
+}
+
+func (s *s3ArtifactStore) uploadThroughBackend(ctx context.Context, obj ArtifactObject, srcDir string, opts utils.ZipOptions) (Location, utils.ZipResult, error) {
+	bucket, _, err := s.target(obj.Region)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+
+	stageKey := fmt.Sprintf("%s/%s/%s/%s", obj.Token, obj.ProjectName, obj.Region, obj.Stage)
+	mu, _ := s.backendUploads.LoadOrStore(stageKey, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	s3URLUpload, archive, err := utils.UploadDirectoryToS3(ctx, srcDir, obj.ProjectName, obj.Region, obj.Stage, obj.Token, opts)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+
+	// Parse upload s3 url to extract key
+	s3ParsedURL, err := url.Parse(s3URLUpload)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+
+	// The next upload of the stage overwrites the backend key, the build keeps
+	// a copy of its own
+	location := Location{
+		Region: obj.Region,
+		Bucket: bucket,
+		Key:    objectKey(obj),
+	}
+	svc, err := s.newClient(obj.Region)
+	if err != nil {
+		return Location{}, utils.ZipResult{}, err
+	}
+	_, err = svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(location.Bucket),
+		Key:        aws.String(location.Key),
+		CopySource: aws.String((&url.URL{Path: bucket + s3ParsedURL.Path}).EscapedPath()),
+	})
+	if err != nil {
+		return Location{}, utils.ZipResult{}, fmt.Errorf("failed to copy the archive to %s: %v", location.Key, err)
+	}
+
+	return location, archive, nil
+}
+
+// PresignDownload implements ArtifactStore.
+func (s *s3ArtifactStore) PresignDownload(ctx context.Context, location Location) (string, error) {
+	svc, err := s.newClient(location.Region)
+	if err != nil {
+		return "", err
+	}
+
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(location.Bucket),
+		Key:    aws.String(location.Key),
+	})
+	req.SetContext(ctx)
+	urlStr, err := req.Presign(presignExpiry)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	return urlStr, nil
+}
+
+// ETag implements ArtifactStore.
+func (s *s3ArtifactStore) ETag(ctx context.Context, location Location) (string, error) {
+	svc, err := s.newClient(location.Region)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(location.Bucket),
+		Key:    aws.String(location.Key),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(res.ETag), nil
+}
+
+// objectKey namespaces artifacts by a digest of the owner token so that
+// projects with the same name from different users never share a key. Every
+// build has its own archive, a newer deploy of the stage must not replace the
+// code of a build that is still queued.
+func objectKey(obj ArtifactObject) string {
+	owner := sha256.Sum256([]byte(obj.Token))
+	return fmt.Sprintf("%s/%s/%s/%s/%s/projectCode.zip", hex.EncodeToString(owner[:8]), obj.ProjectName, obj.Region, obj.Stage, obj.JobID)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"build-machine/internal"
+	"build-machine/utils"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ArtifactObject identifies the build an uploaded archive belongs to.
+type ArtifactObject struct {
+	Token       string
+	ProjectName string
+	Region      string
+	Stage       string
+	// JobID keeps the archives of queued builds of a stage apart
+	JobID string
+}
+
+// Location points at a stored artifact.
+type Location struct {
+	Region string
+	Bucket string
+	Key    string
+}
+
+type ArtifactStore interface {
+	// UploadDirectory archives srcDir and stores it for the given object.
+	UploadDirectory(ctx context.Context, obj ArtifactObject, srcDir string, opts utils.ZipOptions) (Location, utils.ZipResult, error)
+	// PresignDownload returns a URL the builder can fetch the artifact from without credentials.
+	PresignDownload(ctx context.Context, location Location) (string, error)
+	// ETag returns the current version identifier of the artifact, or an error if it is missing.
+	ETag(ctx context.Context, location Location) (string, error)
+}
+
+const (
+	StoreAWS          = "aws"
+	StoreS3Compatible = "s3"
+	StoreLocal        = "local"
+)
+
+var AvailableStores = []string{
+	StoreAWS,
+	StoreS3Compatible,
+	StoreLocal,
+}
+
+var (
+	store     ArtifactStore
+	storeErr  error
+	storeOnce sync.Once
+)
+
+// GetArtifactStore returns the artifact store selected by ARTIFACT_STORE.
+func GetArtifactStore() (ArtifactStore, error) {
+	storeOnce.Do(func() {
+		store, storeErr = newArtifactStore()
+	})
+	return store, storeErr
+}
+
+func newArtifactStore() (ArtifactStore, error) {
+	config := internal.GetConfig().Artifacts
+	switch config.Store {
+	case StoreAWS:
+		return NewAWSArtifactStore(), nil
+	case StoreS3Compatible:
+		return NewS3CompatibleArtifactStore()
+	case StoreLocal:
+		return NewLocalArtifactStore(config.LocalDir, config.PublicURL)
+	default:
+		return nil, fmt.Errorf("unknown ARTIFACT_STORE %q, one of %v", config.Store, AvailableStores)
+	}
+}
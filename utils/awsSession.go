@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"build-machine/internal"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const roleSessionName = "genezio-build-machine"
+
+// NewAWSSession creates a session for region authenticated with the given
+// credentials source. Extra configs are merged on top, e.g. custom endpoints.
+func NewAWSSession(region string, creds internal.CredentialsConfig, configs ...*aws.Config) (*session.Session, error) {
+	baseConfig := aws.NewConfig().
+		WithRegion(region).
+		WithCredentialsChainVerboseErrors(true)
+	if creds.Source == internal.CredentialsStatic {
+		baseConfig = baseConfig.WithCredentials(credentials.NewStaticCredentials(creds.AccessKeyID, creds.SecretAccessKey, ""))
+	}
+	for _, cfg := range configs {
+		baseConfig.MergeIn(cfg)
+	}
+
+	sess, err := session.NewSession(baseConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	switch creds.Source {
+	case internal.CredentialsStatic:
+	case internal.CredentialsIAMRole:
+		// Without a role ARN the default chain already resolves the machine role
+		if creds.RoleARN != "" {
+			sess.Config.Credentials = stscreds.NewCredentials(sess, creds.RoleARN)
+		}
+	case internal.CredentialsWebIdentity:
+		roleARN := creds.RoleARN
+		if roleARN == "" {
+			roleARN = os.Getenv("AWS_ROLE_ARN")
+		}
+		tokenFile := creds.WebIdentityTokenFile
+		if tokenFile == "" {
+			tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		sess.Config.Credentials = stscreds.NewWebIdentityCredentials(sess, roleARN, roleSessionName, tokenFile)
+	default:
+		return nil, fmt.Errorf("unknown credentials source %q", creds.Source)
+	}
+
+	return sess, nil
+}
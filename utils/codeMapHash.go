@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+
+	"golang.org/x/exp/maps"
+)
+
+// HashCodeMap returns a SHA-256 digest of a code map that only depends on the
+// file paths and their contents, so identical projects always hash the same.
+func HashCodeMap(code map[string]string) string {
+	fileNames := maps.Keys(code)
+	slices.Sort(fileNames)
+
+	h := sha256.New()
+	for _, fileName := range fileNames {
+		// Length prefixes keep ("ab", "c") and ("a", "bc") from colliding
+		binary.Write(h, binary.BigEndian, uint64(len(fileName)))
+		h.Write([]byte(fileName))
+		binary.Write(h, binary.BigEndian, uint64(len(code[fileName])))
+		h.Write([]byte(code[fileName]))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
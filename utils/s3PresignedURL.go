@@ -2,18 +2,15 @@ package utils
 
 import (
 	"build-machine/internal"
+	"build-machine/tracing"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
-	"os"
-	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type reqCreatePresignedURLBody struct {
@@ -28,12 +25,7 @@ type resCreatePresignedURLBody struct {
 	Domain       string `json:"domain"`
 }
 
-func UploadContentToS3(archivePath, projectName, region, stage, token string) (string, error) {
-	client := &http.Client{}
-	if archivePath == "" {
-		return "", fmt.Errorf("archivePath is empty")
-	}
-	// Get the presigned URL from the environment
+func createProjectCodeURL(ctx context.Context, client *http.Client, projectName, region, stage, token string) (string, error) {
 	presignEndpoint := fmt.Sprintf("%s/core/create-project-code-url", internal.GetConfig().BackendURL)
 	body := reqCreatePresignedURLBody{
 		ProjectName: projectName,
@@ -46,7 +38,7 @@ func UploadContentToS3(archivePath, projectName, region, stage, token string) (s
 		return "", err
 	}
 
-	reqPresign, err := http.NewRequest("POST", presignEndpoint, bytes.NewBuffer(bodyBytes))
+	reqPresign, err := http.NewRequestWithContext(ctx, "POST", presignEndpoint, bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		return "", err
 	}
@@ -59,12 +51,12 @@ func UploadContentToS3(archivePath, projectName, region, stage, token string) (s
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("failed to get presigned URL: %s", res.Status)
 	}
 
-	var presignedURL string
 	resbody := resCreatePresignedURLBody{}
 	if err = json.NewDecoder(res.Body).Decode(&resbody); err != nil {
 		return "", err
@@ -74,81 +66,65 @@ func UploadContentToS3(archivePath, projectName, region, stage, token string) (s
 		return "", fmt.Errorf("failed to get presigned URL: %s", res.Status)
 	}
 
-	presignedURL = resbody.PresignedURL
-	// Upload the archive to S3
-	f, err := os.Open(archivePath)
-	if err != nil {
-		return "", err
+	return resbody.PresignedURL, nil
+}
+
+// UploadDirectoryToS3 zips srcDir and streams the archive straight into a
+// presigned PUT obtained from the backend. It returns the presigned URL used
+// for the upload together with the archive size and checksum.
+func UploadDirectoryToS3(ctx context.Context, srcDir, projectName, region, stage, token string, opts ZipOptions) (presignedURL string, archive ZipResult, err error) {
+	ctx, span := tracing.Start(ctx, "UploadDirectoryToS3")
+	defer func() {
+		span.SetAttributes(attribute.Int64("archive.size", archive.Size))
+		tracing.End(span, err)
+	}()
+
+	client := &http.Client{}
+	if srcDir == "" {
+		return "", ZipResult{}, fmt.Errorf("srcDir is empty")
 	}
 
-	fStat, err := f.Stat()
+	// S3 rejects presigned PUTs without a Content-Length, so a first pass
+	// measures the archive without storing it. This also enforces the size
+	// limit before anything is requested from the backend.
+	archive, err = ZipDirectoryTo(srcDir, io.Discard, opts)
 	if err != nil {
-		return "", err
+		return "", ZipResult{}, err
 	}
 
-	fileBuf := make([]byte, fStat.Size())
-	_, err = f.Read(fileBuf)
+	presignedURL, err = createProjectCodeURL(ctx, client, projectName, region, stage, token)
 	if err != nil {
-		return "", err
+		return "", ZipResult{}, err
 	}
 
-	reqUpload, err := http.NewRequest("PUT", presignedURL, bytes.NewBuffer(fileBuf))
+	pipeReader, pipeWriter := io.Pipe()
+	// Unblocks the archiver if the request returns before consuming the body
+	defer pipeReader.Close()
+	go func() {
+		streamed, err := ZipDirectoryTo(srcDir, pipeWriter, opts)
+		if err == nil && streamed.SHA256 != archive.SHA256 {
+			err = fmt.Errorf("source directory changed during upload")
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	reqUpload, err := http.NewRequestWithContext(ctx, "PUT", presignedURL, pipeReader)
 	if err != nil {
-		return "", err
+		return "", ZipResult{}, err
 	}
-
-	fileSizeStr := fmt.Sprintf("%d", fStat.Size())
+	reqUpload.ContentLength = archive.Size
 	reqUpload.Header.Add("Content-Type", "application/octet-stream")
-	reqUpload.Header.Add("Content-Length", fileSizeStr)
 
 	resp, err := client.Do(reqUpload)
 	if err != nil {
-		return "", err
+		return "", ZipResult{}, err
 	}
+	defer resp.Body.Close()
 
-	// decode response body in bytes
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	respBody := buf.String()
-	fmt.Println(respBody)
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to upload archive to S3: %s", resp.Status)
-	}
-
-	return presignedURL, nil
-}
-
-func DownloadFromS3PresignedURL(region, bucket, key string) (string, error) {
-	accessKeyID := internal.GetConfig().AWSAccessKeyID
-	secretAccessKey := internal.GetConfig().AWSSecretAccessKey
-
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region),
-		Credentials: credentials.NewStaticCredentials(
-			accessKeyID,
-			secretAccessKey,
-			"",
-		),
-	})
-
-	if err != nil {
-		log.Println("Failed to create session", err)
-		return "", err
-	}
-	// Create S3 service client
-	svc := s3.New(sess)
-
-	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	urlStr, err := req.Presign(15 * time.Minute)
-
-	if err != nil {
-		log.Println("Failed to sign request", err)
-		return "", err
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", ZipResult{}, fmt.Errorf("failed to upload archive to S3: %s %s", resp.Status, string(respBody))
 	}
 
-	log.Println("The URL is", urlStr)
-	return urlStr, nil
+	return presignedURL, archive, nil
 }
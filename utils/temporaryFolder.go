@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"os"
 	"path"
@@ -13,14 +14,14 @@ func CreateTempFolder() string {
 
 	err := os.Mkdir(path.Join(tmpDir, folderName), 0755)
 	if err != nil {
-		fmt.Println(err)
+		slog.Warn("Failed to create temporary folder", "error", err)
 	}
 
 	randomSubfolder := fmt.Sprintf("%d", rand.Int31())
 	finalPath := path.Join(tmpDir, folderName, randomSubfolder)
 	err = os.Mkdir(finalPath, 0755)
 	if err != nil {
-		fmt.Println(err)
+		slog.Warn("Failed to create temporary folder", "error", err)
 	}
 
 	return finalPath
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"build-machine/internal"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// userTTL is how long the user of a token is reused before asking
+// the backend again.
+const userTTL = 5 * time.Minute
+
+type resGetUserBody struct {
+	Status string `json:"status"`
+	User   struct {
+		ID               string `json:"id"`
+		SubscriptionPlan string `json:"subscriptionPlan"`
+	} `json:"user"`
+}
+
+// User is the genezio account owning a token.
+type User struct {
+	ID               string
+	SubscriptionPlan string
+}
+
+type cachedUser struct {
+	user      User
+	fetchedAt time.Time
+}
+
+var (
+	usersMu sync.Mutex
+	users   = make(map[string]cachedUser)
+)
+
+// GetUser returns the user owning token, as reported by the genezio backend.
+func GetUser(ctx context.Context, token string) (User, error) {
+	usersMu.Lock()
+	cached, ok := users[token]
+	usersMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < userTTL {
+		return cached.user, nil
+	}
+
+	user, err := fetchUser(ctx, token)
+	if err != nil {
+		return User{}, err
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	// Drop the expired users while holding the lock anyway
+	for cachedToken, cached := range users {
+		if time.Since(cached.fetchedAt) >= userTTL {
+			delete(users, cachedToken)
+		}
+	}
+	users[token] = cachedUser{user: user, fetchedAt: time.Now()}
+	return user, nil
+}
+
+func fetchUser(ctx context.Context, token string) (User, error) {
+	userEndpoint := fmt.Sprintf("%s/users/user", internal.GetConfig().BackendURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", userEndpoint, nil)
+	if err != nil {
+		return User{}, err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Version", "genezio-cli/2.0.3")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return User{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return User{}, fmt.Errorf("failed to get user: %s", res.Status)
+	}
+
+	resbody := resGetUserBody{}
+	if err = json.NewDecoder(res.Body).Decode(&resbody); err != nil {
+		return User{}, err
+	}
+	return User{
+		ID:               resbody.User.ID,
+		SubscriptionPlan: resbody.User.SubscriptionPlan,
+	}, nil
+}
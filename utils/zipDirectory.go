@@ -3,7 +3,13 @@ package utils
 import (
 	"archive/tar"
 	"archive/zip"
+	"build-machine/internal"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
@@ -11,6 +17,54 @@ import (
 	"strings"
 )
 
+// ErrArchiveTooLarge is returned when an archive grows past ZipOptions.MaxSize.
+var ErrArchiveTooLarge = errors.New("archive exceeds the maximum allowed size")
+
+type ZipOptions struct {
+	// CompressionLevel follows compress/flate: 0 stores entries uncompressed,
+	// 1-9 trade speed for size and -1 selects the default level.
+	CompressionLevel int
+	// MaxSize is the maximum archive size in bytes, 0 disables the check.
+	MaxSize int64
+}
+
+var DefaultZipOptions = ZipOptions{
+	CompressionLevel: flate.DefaultCompression,
+}
+
+// ZipOptionsFromConfig builds the archive options used for uploaded source code.
+func ZipOptionsFromConfig() ZipOptions {
+	return ZipOptions{
+		CompressionLevel: internal.GetConfig().ArchiveCompressionLevel,
+		MaxSize:          internal.GetConfig().MaxArchiveSize,
+	}
+}
+
+type ZipResult struct {
+	Size   int64
+	SHA256 string
+}
+
+// archiveWriter counts and hashes everything written to the underlying writer
+// and fails once the configured size limit is crossed.
+type archiveWriter struct {
+	w       io.Writer
+	hash    hash.Hash
+	size    int64
+	maxSize int64
+}
+
+func (a *archiveWriter) Write(p []byte) (int, error) {
+	if a.maxSize > 0 && a.size+int64(len(p)) > a.maxSize {
+		return 0, ErrArchiveTooLarge
+	}
+	n, err := a.w.Write(p)
+	a.hash.Write(p[:n])
+	a.size += int64(n)
+	return n, err
+}
+
+// ZipDirectory archives srcToZip into the file at dstToZip using the default options.
 func ZipDirectory(srcToZip, dstToZip string) error {
 	destinationFile, err := os.Create(dstToZip)
 	if err != nil {
@@ -18,9 +72,56 @@ func ZipDirectory(srcToZip, dstToZip string) error {
 	}
 	defer destinationFile.Close()
 
+	if _, err := ZipDirectoryTo(srcToZip, destinationFile, DefaultZipOptions); err != nil {
+		return err
+	}
+	return destinationFile.Close()
+}
+
+// ZipDirectoryTo streams a zip archive of srcToZip into w. Entries keep their
+// file mode and modification time, and the archive is never held in memory.
+func ZipDirectoryTo(srcToZip string, w io.Writer, opts ZipOptions) (ZipResult, error) {
+	if opts.CompressionLevel < flate.HuffmanOnly || opts.CompressionLevel > flate.BestCompression {
+		return ZipResult{}, fmt.Errorf("invalid compression level %d", opts.CompressionLevel)
+	}
+
+	out := &archiveWriter{
+		w:       w,
+		hash:    sha256.New(),
+		maxSize: opts.MaxSize,
+	}
+	myZip := zip.NewWriter(out)
+	myZip.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, opts.CompressionLevel)
+	})
+	method := zip.Deflate
+	if opts.CompressionLevel == flate.NoCompression {
+		method = zip.Store
+	}
+
+	err := WalkDirectory(srcToZip, func(filePath, name string, info os.FileInfo) error {
+		return addZipEntry(myZip, filePath, name, info, method)
+	})
+	if err != nil {
+		return ZipResult{}, err
+	}
+	if err := myZip.Close(); err != nil {
+		return ZipResult{}, err
+	}
+
+	return ZipResult{
+		Size:   out.size,
+		SHA256: hex.EncodeToString(out.hash.Sum(nil)),
+	}, nil
+}
+
+// WalkDirectory calls fn for every file and directory below srcDir that is not
+// excluded from the uploaded code, name is the slash separated path relative
+// to srcDir.
+func WalkDirectory(srcDir string, fn func(filePath, name string, info os.FileInfo) error) error {
 	var exclusionsList []string
 	for _, exclusion := range ExcludedFiles {
-		files, err := filepath.Glob(srcToZip + "/" + exclusion)
+		files, err := filepath.Glob(srcDir + "/" + exclusion)
 		if err != nil {
 			return err
 		}
@@ -28,55 +129,70 @@ func ZipDirectory(srcToZip, dstToZip string) error {
 		exclusionsList = append(exclusionsList, files...)
 	}
 
-	myZip := zip.NewWriter(destinationFile)
-	defer myZip.Close()
-	err = filepath.Walk(srcToZip, func(filePath string, info os.FileInfo, walkErr error) error {
+	return filepath.Walk(srcDir, func(filePath string, info os.FileInfo, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
 		}
 
 		// Create the relative path for the file
-		relPath, err := filepath.Rel(srcToZip, filePath)
+		relPath, err := filepath.Rel(srcDir, filePath)
 		if err != nil {
 			return err
 		}
-
-		// Skip excluded files
-		if slices.Contains(exclusionsList, filePath) {
+		if relPath == "." {
 			return nil
 		}
 
-		// If it's a directory, create it in the zip file
-		if info.IsDir() {
-			_, err := myZip.Create(relPath + "/")
-			if err != nil {
-				return err
+		// Skip excluded files, and everything below excluded directories
+		if slices.Contains(exclusionsList, filePath) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		// Otherwise, it's a file, so add it to the zip
-		zipFile, err := myZip.Create(relPath)
-		if err != nil {
-			return err
-		}
+		return fn(filePath, filepath.ToSlash(relPath), info)
+	})
+}
 
-		fsFile, err := os.Open(filePath)
-		if err != nil {
-			return err
-		}
-		defer fsFile.Close() // Ensure the file is closed after usage
+func addZipEntry(myZip *zip.Writer, filePath, name string, info os.FileInfo, method uint16) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	// If it's a directory, create it in the zip file
+	if info.IsDir() {
+		header.Name += "/"
+		_, err := myZip.CreateHeader(header)
+		return err
+	}
 
-		_, err = io.Copy(zipFile, fsFile)
+	header.Method = method
+	zipFile, err := myZip.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	// Symlinks are stored with their target as content, like the zip CLI does
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
 		if err != nil {
 			return err
 		}
-		return nil
-	})
+		_, err = io.WriteString(zipFile, target)
+		return err
+	}
+
+	fsFile, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer fsFile.Close()
+
+	_, err = io.Copy(zipFile, fsFile)
+	return err
 }
 
 func UntarAll(reader io.Reader, destDir, prefix string) error {
@@ -1,23 +1,26 @@
 package workflows
 
 import (
+	"build-machine/api/types"
 	"build-machine/internal"
+	"build-machine/logging"
 	"build-machine/service"
 	statemanager "build-machine/state_manager"
+	"build-machine/tracing"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"slices"
 
 	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type GitDeploymentArgo struct {
-	GitDeployment
+	types.GitDeployment
 	Token        string
-	ArgoClient   service.ArgoService
+	Clusters     *service.ClusterRegistry
 	StateManager statemanager.StateManager
+	Resources    BuildResources
 }
 
 // AssignStateManager implements Workflow.
@@ -25,76 +28,44 @@ func (d *GitDeploymentArgo) AssignStateManager(state statemanager.StateManager)
 	d.StateManager = state
 }
 
+// AssignResources implements Workflow.
+func (d *GitDeploymentArgo) AssignResources(resources BuildResources) {
+	d.Resources = resources
+}
+
+// Project implements Workflow.
+func (d *GitDeploymentArgo) Project() statemanager.ProjectStage {
+	return statemanager.ProjectStage{
+		ProjectName: d.ProjectName,
+		Region:      d.Region,
+		Stage:       d.Stage,
+	}
+}
+
 // GetState implements Workflow.
 func (d *GitDeploymentArgo) GetState() (WorkflowReport, error) {
 	panic("unimplemented")
 }
 
-// Submit implements Workflow.
-func (d *GitDeploymentArgo) Submit() (string, error) {
-	renderedWorkflow := d.RenderArgoTemplate()
-	wf_id, err := d.ArgoClient.SubmitWorkflow(renderedWorkflow)
-	if err != nil {
-		return "", err
-	}
-
-	err = d.StateManager.CreateState(wf_id, d.Token, "argo")
-	if err != nil {
-		return "", err
-	}
+// Prepare implements Workflow. The repository is cloned by the builder, so
+// there is nothing to do before the build leaves the queue.
+func (d *GitDeploymentArgo) Prepare(ctx context.Context, jobId string) error {
+	return nil
+}
 
-	go func() {
-		maxRetries := 35
-		for {
-			// In the future we should have a better way to handle this
-			// For now we will just poll the status of the workflow
-			// A high number of retries is needed in case of delayed scheduling on the cluster
-			if maxRetries == 0 {
-				break
-			}
-			res, err := d.ArgoClient.ReadStatusFileFromPod(wf_id)
-			if err != nil {
-				fmt.Println(err)
-				maxRetries--
-				continue
-			}
-
-			log.Printf("Workflow %s status: %v", wf_id, res)
-
-			// get current state history
-			state, err := d.StateManager.GetState(wf_id)
-			if err != nil {
-				fmt.Println(err)
-				break
-			}
-
-			for _, retrievedState := range res {
-				seenThisState := slices.ContainsFunc(state.Transitions, func(i statemanager.StateTransition) bool {
-					return retrievedState.Status == string(i.From) || retrievedState.Status == string(i.To)
-				})
-
-				if !seenThisState {
-					d.StateManager.UpdateState(wf_id, retrievedState.Message, statemanager.BuildStatus(retrievedState.Status))
-				}
-
-				if retrievedState.Status == "SUCCEEDED" || retrievedState.Status == "FAILED" {
-					return
-				}
-			}
-		}
-	}()
-	return wf_id, nil
+// Submit implements Workflow.
+func (d *GitDeploymentArgo) Submit(ctx context.Context, jobId string, done func(err error)) error {
+	ctx = logging.With(ctx, "project", d.ProjectName, "region", d.Region, "stage", d.Stage)
+	return submitWorkflow(ctx, d.Clusters, d.StateManager, jobId, d.Token, d.Region, d.Resources, "git", d.RenderArgoTemplate, done)
 }
 
 // Validated implements Workflow.
-func (d *GitDeploymentArgo) Validate(args json.RawMessage) error {
+func (d *GitDeploymentArgo) Validate(ctx context.Context, args json.RawMessage) error {
 	err := json.Unmarshal(args, &d)
 	if err != nil {
 		return err
 	}
-	//convert args to string and print it
-	log.Printf("args = %v", string(args))
-	log.Printf("Args: %v %v %v", d.ProjectName, d.Repository, d.Region)
+	logging.FromContext(ctx).Debug("Validating git deployment", "project", d.ProjectName, "repository", d.Repository, "region", d.Region)
 	if d.Repository == "" {
 		return fmt.Errorf("repository is required")
 	}
@@ -103,23 +74,21 @@ func (d *GitDeploymentArgo) Validate(args json.RawMessage) error {
 		return fmt.Errorf("projectName is required")
 	}
 
-	if d.Region == "" {
-		return fmt.Errorf("region is required")
+	if err := internal.GetDeployConfig().ValidateRegion(d.Region); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func NewGitArgoWorkflow(token string) Workflow {
-	argoService := service.NewArgoService()
-
+func NewGitArgoWorkflow(token string, clusters *service.ClusterRegistry) Workflow {
 	return &GitDeploymentArgo{
-		Token:      token,
-		ArgoClient: *argoService,
+		Token:    token,
+		Clusters: clusters,
 	}
 }
 
-func (d *GitDeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
+func (d *GitDeploymentArgo) RenderArgoTemplate(ctx context.Context) wfv1.Workflow {
 	tokenAS := wfv1.ParseAnyString(d.Token)
 	repoAS := wfv1.ParseAnyString(d.Repository)
 	regionAS := wfv1.ParseAnyString(d.Region)
@@ -128,6 +97,7 @@ func (d *GitDeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
 	stackAS := wfv1.ParseAnyString("")
 	stage := wfv1.ParseAnyString(d.Stage)
 	isNewProjectAS := wfv1.ParseAnyString(fmt.Sprintf("%t", d.IsNewProject))
+	traceParentAS := wfv1.ParseAnyString(tracing.TraceParent(ctx))
 
 	if d.BasePath != nil {
 		basePathAS = wfv1.ParseAnyString(*d.BasePath)
@@ -136,21 +106,13 @@ func (d *GitDeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
 	if d.Stack != nil {
 		jsonData, err := json.Marshal(d.Stack)
 		if err != nil {
-			log.Println("Error marshalling stack", d.Stack)
+			logging.FromContext(ctx).Warn("Error marshalling stack", "stack", d.Stack, "error", err)
 		} else {
 			stackAS = wfv1.ParseAnyString(string(jsonData))
 		}
 	}
-	log.Printf("stackAS = %v", stackAS)
-
-	templateName := "build-git"
-	templateRef := "genezio-build-git-template"
-	generateName := "genezio-build-git-"
-	if internal.GetConfig().Env == "dev" || internal.GetConfig().Env == "local" {
-		templateName = "build-git-dev"
-		templateRef = "genezio-build-git-template-dev"
-		generateName = "genezio-build-git-dev-"
-	}
+
+	templateName, templateRefName, generateName := argoTemplate("git")
 
 	return wfv1.Workflow{
 		ObjectMeta: metav1.ObjectMeta{
@@ -166,11 +128,8 @@ func (d *GitDeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
 						{
 							Steps: []wfv1.WorkflowStep{
 								{
-									Name: "genezio-deploy",
-									TemplateRef: &wfv1.TemplateRef{
-										Name:     templateRef,
-										Template: templateName,
-									},
+									Name:        "genezio-deploy",
+									TemplateRef: templateRef(templateRefName, templateName),
 									Arguments: wfv1.Arguments{
 										Parameters: []wfv1.Parameter{
 											{
@@ -205,6 +164,10 @@ func (d *GitDeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
 												Name:  "stage",
 												Value: &stage,
 											},
+											{
+												Name:  "traceparent",
+												Value: &traceParentAS,
+											},
 										},
 									},
 								},
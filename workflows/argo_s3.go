@@ -1,28 +1,38 @@
 package workflows
 
 import (
+	"build-machine/api/types"
 	"build-machine/internal"
+	"build-machine/logging"
+	"build-machine/metrics"
 	"build-machine/service"
 	statemanager "build-machine/state_manager"
+	"build-machine/storage"
+	"build-machine/tracing"
 	"build-machine/utils"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net/url"
 	"os"
-	"slices"
-	"strings"
+	"time"
 
 	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"go.opentelemetry.io/otel/attribute"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type S3DeploymentArgo struct {
-	S3Deployment
+	types.S3Deployment
 	Token               string
 	CodeAlreadyUploaded bool
-	ArgoClient          service.ArgoService
+	Archive             *statemanager.ArchiveInfo
+	Clusters            *service.ClusterRegistry
 	StateManager        statemanager.StateManager
+	Resources           BuildResources
+	// archiveLocation is presigned when the build leaves the queue, so the
+	// download URL doesn't expire while the build waits
+	archiveLocation *storage.Location
 }
 
 // AssignStateManager implements Workflow.
@@ -30,8 +40,13 @@ func (d *S3DeploymentArgo) AssignStateManager(state statemanager.StateManager) {
 	d.StateManager = state
 }
 
+// AssignResources implements Workflow.
+func (d *S3DeploymentArgo) AssignResources(resources BuildResources) {
+	d.Resources = resources
+}
+
 // Validated implements Workflow.
-func (d *S3DeploymentArgo) Validate(args json.RawMessage) error {
+func (d *S3DeploymentArgo) Validate(ctx context.Context, args json.RawMessage) error {
 	err := json.Unmarshal(args, &d)
 	if err != nil {
 		return err
@@ -43,8 +58,8 @@ func (d *S3DeploymentArgo) Validate(args json.RawMessage) error {
 		return fmt.Errorf("projectName is required")
 	}
 
-	if d.Region == "" {
-		return fmt.Errorf("region is required")
+	if err := internal.GetDeployConfig().ValidateRegion(d.Region); err != nil {
+		return err
 	}
 
 	if d.Token == "" {
@@ -52,132 +67,196 @@ func (d *S3DeploymentArgo) Validate(args json.RawMessage) error {
 	}
 
 	if !d.CodeAlreadyUploaded {
-		if d.Code == nil {
+		if d.Code == nil && d.CodeBase64 == nil {
 			return fmt.Errorf("if code has not been uploaded to s3 previously, codemap is required")
 		}
+		if err := d.decodeBinaryCode(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// decodeBinaryCode moves the files of CodeBase64 into the code map.
+func (d *S3DeploymentArgo) decodeBinaryCode() error {
+	if len(d.CodeBase64) == 0 {
+		return nil
+	}
+	if d.Code == nil {
+		d.Code = make(map[string]string, len(d.CodeBase64))
+	}
+	for fileName, encoded := range d.CodeBase64 {
+		if _, ok := d.Code[fileName]; ok {
+			return fmt.Errorf("%s is in both code and codeBase64", fileName)
+		}
+		content, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("codeBase64 %s: %v", fileName, err)
+		}
+		d.Code[fileName] = string(content)
+	}
+	d.CodeBase64 = nil
+	return nil
+}
+
+// Project implements Workflow.
+func (d *S3DeploymentArgo) Project() statemanager.ProjectStage {
+	return statemanager.ProjectStage{
+		ProjectName: d.ProjectName,
+		Region:      d.Region,
+		Stage:       d.Stage,
+	}
+}
+
 // GetState implements Workflow.
 func (d *S3DeploymentArgo) GetState() (WorkflowReport, error) {
 	panic("unimplemented")
 }
 
-func (d *S3DeploymentArgo) uploadCode() error {
-	tmpFolderPath := utils.CreateTempFolder()
-	archivePath, err := utils.WriteCodeMapToDirAndZip(d.Code, tmpFolderPath)
-	log.Println("Archive path", archivePath)
+func (d *S3DeploymentArgo) archiveKey() statemanager.ArchiveKey {
+	return statemanager.ArchiveKey{
+		Token:       d.Token,
+		ProjectName: d.ProjectName,
+		Region:      d.Region,
+		Stage:       d.Stage,
+	}
+}
+
+// reuseArchive picks a previously uploaded archive with the same content. The
+// object is only reused if it was not overwritten since.
+func (d *S3DeploymentArgo) reuseArchive(ctx context.Context, store storage.ArtifactStore, contentHash string) bool {
+	logger := logging.FromContext(ctx)
+	record, ok := d.StateManager.GetArchiveRecord(d.archiveKey())
+	if !ok || record.ContentHash != contentHash {
+		return false
+	}
+
+	location := storage.Location{
+		Region: d.Region,
+		Bucket: record.Bucket,
+		Key:    record.Key,
+	}
+	etag, err := store.ETag(ctx, location)
+	if err != nil || etag != record.ETag {
+		logger.Info("Cached archive is no longer valid", "bucket", record.Bucket, "key", record.Key, "error", err)
+		return false
+	}
+
+	logger.Info("Reusing cached archive", "bucket", record.Bucket, "key", record.Key, "uploaded_at", record.UploadedAt)
+	d.archiveLocation = &location
+	d.Archive = &record.Archive
+	return true
+}
+
+func (d *S3DeploymentArgo) uploadCode(ctx context.Context, jobId string) (err error) {
+	ctx, span := tracing.Start(ctx, "uploadCode")
+	defer func() { tracing.End(span, err) }()
+	logger := logging.FromContext(ctx)
+	store, err := storage.GetArtifactStore()
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpFolderPath)
 
-	s3URLUpload, err := utils.UploadContentToS3(archivePath, d.ProjectName, d.Region, d.Stage, d.Token)
-	if err != nil {
+	contentHash := utils.HashCodeMap(d.Code)
+	if d.reuseArchive(ctx, store, contentHash) {
+		span.SetAttributes(attribute.Bool("archive.cached", true))
+		return nil
+	}
+
+	tmpFolderPath := utils.CreateTempFolder()
+	defer os.RemoveAll(tmpFolderPath)
+	if err := utils.WriteCodeMapToDir(ctx, d.Code, tmpFolderPath); err != nil {
 		return err
 	}
-	// Parse upload s3 url to extract key
-	s3ParsedURL, err := url.Parse(s3URLUpload)
+
+	storeName := internal.GetConfig().Artifacts.Store
+	uploadStart := time.Now()
+	location, archive, err := store.UploadDirectory(ctx, storage.ArtifactObject{
+		Token:       d.Token,
+		ProjectName: d.ProjectName,
+		Region:      d.Region,
+		Stage:       d.Stage,
+		JobID:       jobId,
+	}, tmpFolderPath, utils.ZipOptionsFromConfig())
 	if err != nil {
 		return err
 	}
+	metrics.ArchiveUploadDuration.WithLabelValues(storeName).Observe(time.Since(uploadStart).Seconds())
+	metrics.ArchiveUploadSize.WithLabelValues(storeName).Observe(float64(archive.Size))
+	logger.Info("Uploaded source archive", "size", archive.Size, "sha256", archive.SHA256)
+	d.Archive = &statemanager.ArchiveInfo{
+		Size:   archive.Size,
+		SHA256: archive.SHA256,
+	}
+
+	d.archiveLocation = &location
 
-	uploadKey := strings.TrimLeft(s3ParsedURL.Path, "/")
-	// Call service
-	bucketBaseName := internal.GetConfig().BucketBaseName
-	log.Println("Bucket base name", bucketBaseName)
-	s3URLDownload, err := utils.DownloadFromS3PresignedURL(d.Region, fmt.Sprintf("%s-%s", bucketBaseName, d.Region), uploadKey)
+	// Remember the upload so an unchanged project can skip it next time
+	etag, err := store.ETag(ctx, location)
 	if err != nil {
-		return err
+		logger.Warn("Failed to read archive ETag, not caching it", "bucket", location.Bucket, "key", location.Key, "error", err)
+		return nil
 	}
-	d.S3DownloadURL = s3URLDownload
-	return nil
+	return d.StateManager.PutArchiveRecord(d.archiveKey(), statemanager.ArchiveRecord{
+		ContentHash: contentHash,
+		Bucket:      location.Bucket,
+		Key:         location.Key,
+		ETag:        etag,
+		Archive:     *d.Archive,
+		UploadedAt:  time.Now(),
+	})
 }
 
-// Submit implements Workflow.
-func (d *S3DeploymentArgo) Submit() (string, error) {
+// Prepare implements Workflow. The code is uploaded right away so the
+// request body doesn't have to be kept while the build is queued.
+func (d *S3DeploymentArgo) Prepare(ctx context.Context, jobId string) error {
+	ctx = logging.With(ctx, "project", d.ProjectName, "region", d.Region, "stage", d.Stage)
 	if !d.CodeAlreadyUploaded {
-		err := d.uploadCode()
+		err := d.uploadCode(ctx, jobId)
 		if err != nil {
-			return "", err
+			return err
 		}
+		// The code map is no longer needed
+		d.Code = nil
 	}
-	renderedWorkflow := d.RenderArgoTemplate()
-	wf_id, err := d.ArgoClient.SubmitWorkflow(renderedWorkflow)
-	if err != nil {
-		return "", err
+	if d.Archive != nil {
+		return d.StateManager.SetArchiveInfo(jobId, *d.Archive)
 	}
-	err = d.StateManager.CreateState(wf_id, d.Token, "argo")
-	if err != nil {
-		return "", err
-	}
-
-	go func() {
-		// In the future we should have a better way to handle this
-		// For now we will just poll the status of the workflow
-		// A high number of retries is needed in case of delayed scheduling on the cluster
-		maxRetries := 35
-		for {
-			log.Printf("Polling workflow %s status", wf_id)
-			if maxRetries == 0 {
-				break
-			}
-			res, err := d.ArgoClient.ReadStatusFileFromPod(wf_id)
-			if err != nil {
-				fmt.Println(err)
-				maxRetries--
-				continue
-			}
-			log.Printf("Workflow %s status: %v", wf_id, res)
-
-			// get current state history
-			state, err := d.StateManager.GetState(wf_id)
-			if err != nil {
-				fmt.Println(err)
-				break
-			}
-
-			for _, retrievedState := range res {
-				seenThisState := slices.ContainsFunc(state.Transitions, func(i statemanager.StateTransition) bool {
-					return retrievedState.Status == string(i.From) || retrievedState.Status == string(i.To)
-				})
-
-				if !seenThisState {
-					d.StateManager.UpdateState(wf_id, retrievedState.Message, statemanager.BuildStatus(retrievedState.Status))
-				}
-
-				if retrievedState.Status == "SUCCEEDED" || retrievedState.Status == "FAILED" {
-					return
-				}
-			}
+	return nil
+}
+
+// Submit implements Workflow.
+func (d *S3DeploymentArgo) Submit(ctx context.Context, jobId string, done func(err error)) error {
+	ctx = logging.With(ctx, "project", d.ProjectName, "region", d.Region, "stage", d.Stage)
+	if d.archiveLocation != nil {
+		store, err := storage.GetArtifactStore()
+		if err != nil {
+			return err
 		}
-	}()
-	return wf_id, nil
+		s3URLDownload, err := store.PresignDownload(ctx, *d.archiveLocation)
+		if err != nil {
+			return err
+		}
+		d.S3DownloadURL = s3URLDownload
+	}
+	return submitWorkflow(ctx, d.Clusters, d.StateManager, jobId, d.Token, d.Region, d.Resources, "s3", d.RenderArgoTemplate, done)
 }
 
-func NewS3ArgoDeployment(token string) Workflow {
-	argoService := service.NewArgoService()
+func NewS3ArgoDeployment(token string, clusters *service.ClusterRegistry) Workflow {
 	return &S3DeploymentArgo{
-		Token:      token,
-		ArgoClient: *argoService,
+		Token:    token,
+		Clusters: clusters,
 	}
 }
 
-func (d *S3DeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
+func (d *S3DeploymentArgo) RenderArgoTemplate(ctx context.Context) wfv1.Workflow {
 	tokenAS := wfv1.ParseAnyString(d.Token)
 	stage := wfv1.ParseAnyString(d.Stage)
+	traceParentAS := wfv1.ParseAnyString(tracing.TraceParent(ctx))
 	s3FilePerms := int32(0755)
 
-	templateName := "build-s3"
-	templateRef := "genezio-build-s3-template"
-	generateName := "genezio-build-s3-"
-	if internal.GetConfig().Env == "dev" || internal.GetConfig().Env == "local" {
-		templateName = "build-s3-dev"
-		templateRef = "genezio-build-s3-template-dev"
-		generateName = "genezio-build-s3-dev-"
-	}
+	templateName, templateRefName, generateName := argoTemplate("s3")
 
 	return wfv1.Workflow{
 		ObjectMeta: metav1.ObjectMeta{
@@ -193,11 +272,8 @@ func (d *S3DeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
 						{
 							Steps: []wfv1.WorkflowStep{
 								{
-									Name: "genezio-deploy",
-									TemplateRef: &wfv1.TemplateRef{
-										Name:     templateRef,
-										Template: templateName,
-									},
+									Name:        "genezio-deploy",
+									TemplateRef: templateRef(templateRefName, templateName),
 									Arguments: wfv1.Arguments{
 										Artifacts: []wfv1.Artifact{
 											{
@@ -220,6 +296,10 @@ func (d *S3DeploymentArgo) RenderArgoTemplate() wfv1.Workflow {
 												Name:  "stage",
 												Value: &stage,
 											},
+											{
+												Name:  "traceparent",
+												Value: &traceParentAS,
+											},
 										},
 									},
 								},
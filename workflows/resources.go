@@ -0,0 +1,135 @@
+package workflows
+
+import (
+	"build-machine/api/types"
+	"build-machine/internal"
+	"encoding/json"
+	"fmt"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// builderContainer is the container of the workflow templates running the build.
+const builderContainer = "main"
+
+// BuildResources are the settings applied to the workflow of a build.
+type BuildResources struct {
+	// TimeoutSeconds stops the workflow running for longer, 0 for no limit
+	TimeoutSeconds int64
+	// Image, CPU, Memory and Disk override the builder container, the values
+	// of the workflow template are kept when empty
+	Image  string
+	CPU    string
+	Memory string
+	Disk   string
+}
+
+// ResolveResources returns the resources of a build of tier asking for
+// options, it fails if the options are not configured or not allowed.
+func ResolveResources(tier internal.TierConfig, options types.BuilderOptions) (BuildResources, error) {
+	builder := internal.GetDeployConfig().Builder
+	resources := BuildResources{
+		TimeoutSeconds: tier.BuildTimeoutSeconds,
+		CPU:            tier.CPU,
+		Memory:         tier.Memory,
+	}
+
+	variant := options.Image
+	if variant == "" {
+		variant = builder.DefaultImage
+	}
+	if variant != "" {
+		image, ok := builder.Images[variant]
+		if !ok {
+			return BuildResources{}, fmt.Errorf("builder image %s is not available", variant)
+		}
+		resources.Image = image
+	}
+
+	if options.Size != "" {
+		size, ok := builder.Sizes[options.Size]
+		if !ok {
+			return BuildResources{}, fmt.Errorf("builder size %s is not available", options.Size)
+		}
+		if !tier.AllowsSize(options.Size) {
+			return BuildResources{}, fmt.Errorf("builder size %s is not included in your plan", options.Size)
+		}
+		resources.CPU = size.CPU
+		resources.Memory = size.Memory
+	}
+
+	if options.Disk != "" {
+		disk, err := resource.ParseQuantity(options.Disk)
+		if err != nil {
+			return BuildResources{}, fmt.Errorf("builder disk: %v", err)
+		}
+		if disk.Sign() <= 0 {
+			return BuildResources{}, fmt.Errorf("builder disk must be positive")
+		}
+		if builder.MaxDisk == "" && tier.MaxDisk == "" {
+			return BuildResources{}, fmt.Errorf("builder disk can't be changed")
+		}
+		// Both bounds were validated with the config
+		for _, maxDisk := range []string{builder.MaxDisk, tier.MaxDisk} {
+			if maxDisk != "" && disk.Cmp(resource.MustParse(maxDisk)) > 0 {
+				return BuildResources{}, fmt.Errorf("builder disk can be at most %s", maxDisk)
+			}
+		}
+		resources.Disk = disk.String()
+	}
+	return resources, nil
+}
+
+// apply sets the deadline of the workflow and patches the image and the
+// resources of the builder container.
+func (r BuildResources) apply(workflow *wfv1.Workflow) error {
+	if r.TimeoutSeconds > 0 {
+		timeout := r.TimeoutSeconds
+		workflow.Spec.ActiveDeadlineSeconds = &timeout
+	}
+
+	requests := corev1.ResourceList{}
+	limits := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU:              r.CPU,
+		corev1.ResourceMemory:           r.Memory,
+		corev1.ResourceEphemeralStorage: r.Disk,
+	} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return err
+		}
+		requests[name] = quantity
+	}
+	if disk, ok := requests[corev1.ResourceEphemeralStorage]; ok {
+		// The pod is evicted instead of filling the node's disk
+		limits[corev1.ResourceEphemeralStorage] = disk
+	}
+	if len(requests) == 0 && r.Image == "" {
+		return nil
+	}
+
+	container := corev1.Container{
+		Name:  builderContainer,
+		Image: r.Image,
+		Resources: corev1.ResourceRequirements{
+			Requests: requests,
+		},
+	}
+	if len(limits) > 0 {
+		container.Resources.Limits = limits
+	}
+	patch, err := json.Marshal(corev1.PodSpec{
+		Containers: []corev1.Container{container},
+	})
+	if err != nil {
+		return err
+	}
+	workflow.Spec.PodSpecPatch = string(patch)
+	return nil
+}
@@ -0,0 +1,147 @@
+package workflows
+
+import (
+	"build-machine/logging"
+	"build-machine/metrics"
+	"build-machine/service"
+	statemanager "build-machine/state_manager"
+	"build-machine/tracing"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// statusPollTimeout is how long the status of a build can't be read
+	// before the watcher gives up on it
+	statusPollTimeout = 5 * time.Minute
+	// stopRetryInterval paces the attempts to stop a workflow that was given up
+	stopRetryInterval = 10 * time.Second
+)
+
+// watchWorkflow mirrors the statuses reported by the builder pod of jobId into
+// the state manager until the build finishes or is cancelled. It returns an
+// error if it stopped following the build before that, once the workflow was
+// stopped.
+// The build is traced as one span with a child span for every status.
+func watchWorkflow(ctx context.Context, clusters *service.ClusterRegistry, stateManager statemanager.StateManager, jobId, deployType string) error {
+	ctx, buildSpan := tracing.Start(ctx, "Build",
+		attribute.String("job.id", jobId),
+		attribute.String("deploy.type", deployType),
+	)
+	defer buildSpan.End()
+
+	logger := logging.FromContext(ctx)
+	state, err := stateManager.GetState(jobId)
+	if err != nil {
+		logger.Error("Failed to read job state", "error", err)
+		buildSpan.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to read job state: %w", err)
+	}
+	placement := state.Placement
+	argoClient, err := clusters.Cluster(placement.Cluster)
+	if err != nil {
+		logger.Error("Failed to connect to the build cluster", "cluster", placement.Cluster, "error", err)
+		buildSpan.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to connect to the build cluster %s: %w", placement.Cluster, err)
+	}
+
+	var statusSpan trace.Span
+	defer func() {
+		if statusSpan != nil {
+			statusSpan.End()
+		}
+	}()
+
+	// In the future we should have a better way to handle this
+	// For now we will just poll the status of the workflow
+	var failingSince time.Time
+	for {
+		logger.Debug("Polling workflow status")
+		res, err := argoClient.ReadStatusFileFromPod(ctx, placement.Namespace, jobId)
+		if errors.Is(err, service.ErrPodPending) {
+			// Scheduling can take long on a busy cluster, the deadline of the
+			// workflow bounds it
+			failingSince = time.Time{}
+			continue
+		}
+		if err != nil {
+			logger.Debug("Failed to read workflow status", "error", err)
+			metrics.StatusPollErrors.WithLabelValues(deployType).Inc()
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+			if time.Since(failingSince) < statusPollTimeout {
+				continue
+			}
+			logger.Warn("Giving up polling workflow status", "error", err)
+			buildSpan.SetStatus(codes.Error, "gave up polling workflow status")
+			// The build must not keep running once its slots are given back
+			stopWorkflow(ctx, argoClient, placement.Namespace, jobId)
+			return fmt.Errorf("gave up polling the workflow status: %w", err)
+		}
+		failingSince = time.Time{}
+
+		// get current state history
+		state, err := stateManager.GetState(jobId)
+		if err != nil {
+			logger.Error("Failed to read job state", "error", err)
+			buildSpan.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("failed to read job state: %w", err)
+		}
+		if state.BuildStatus == statemanager.StatusCancelled || state.BuildStatus == statemanager.StatusSuperseded {
+			buildSpan.SetAttributes(attribute.String("build.status", string(state.BuildStatus)))
+			return nil
+		}
+
+		for _, retrievedState := range res {
+			seenThisState := slices.ContainsFunc(state.Transitions, func(i statemanager.StateTransition) bool {
+				return retrievedState.Status == string(i.From) || retrievedState.Status == string(i.To)
+			})
+
+			if !seenThisState {
+				logger.Info("Workflow status changed", "status", retrievedState.Status, "reason", retrievedState.Message)
+				stateManager.UpdateState(jobId, retrievedState.Message, statemanager.BuildStatus(retrievedState.Status))
+				if statusSpan != nil {
+					statusSpan.End()
+				}
+				_, statusSpan = tracing.Start(ctx, retrievedState.Status)
+				buildSpan.AddEvent("status", trace.WithAttributes(attribute.String("status", retrievedState.Status)))
+			}
+
+			if retrievedState.Status == "SUCCEEDED" || retrievedState.Status == "FAILED" {
+				buildSpan.SetAttributes(attribute.String("build.status", retrievedState.Status))
+				if retrievedState.Status == "FAILED" {
+					buildSpan.SetStatus(codes.Error, retrievedState.Message)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// stopWorkflow stops the workflow jobId, retrying until it succeeds, the
+// workflow is gone or ctx is done.
+func stopWorkflow(ctx context.Context, argoClient *service.ArgoService, namespace, jobId string) {
+	logger := logging.FromContext(ctx)
+	for {
+		err := argoClient.CancelWorkflow(ctx, namespace, jobId)
+		if err == nil || apierrors.IsNotFound(err) {
+			logger.Info("Stopped the workflow of the build")
+			return
+		}
+		logger.Warn("Failed to stop the workflow of the build", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(stopRetryInterval):
+		}
+	}
+}
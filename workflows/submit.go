@@ -0,0 +1,70 @@
+package workflows
+
+import (
+	"build-machine/logging"
+	"build-machine/service"
+	statemanager "build-machine/state_manager"
+	"context"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+)
+
+// submitWorkflow schedules the build jobId for region on one of the clusters,
+// submits the workflow returned by render under the name jobId with resources
+// applied and starts mirroring its status. done is called once the build is
+// over, or with an error once its status can't be followed anymore.
+func submitWorkflow(ctx context.Context, clusters *service.ClusterRegistry, stateManager statemanager.StateManager, jobId, token, region string, resources BuildResources, deployType string, render func(context.Context) wfv1.Workflow, done func(err error)) error {
+	clusterName, argoClient, err := clusters.Schedule(ctx, region)
+	if err != nil {
+		return err
+	}
+	ctx = logging.With(ctx, "cluster", clusterName)
+
+	err = func() error {
+		// Tenants are accounts, so every token of a user shares the quota
+		state, err := stateManager.GetState(jobId)
+		if err != nil {
+			return err
+		}
+		account := state.Account
+		if account == "" {
+			account = token
+		}
+		namespace, err := argoClient.PrepareNamespace(ctx, account)
+		if err != nil {
+			return err
+		}
+		workflow := render(ctx)
+		workflow.GenerateName = ""
+		workflow.Name = jobId
+		if err := resources.apply(&workflow); err != nil {
+			return err
+		}
+		_, err = argoClient.SubmitWorkflow(ctx, namespace, workflow)
+		if err != nil {
+			return err
+		}
+
+		err = stateManager.SetPlacement(jobId, statemanager.Placement{
+			Cluster:   clusterName,
+			Namespace: namespace,
+		})
+		if err != nil {
+			return err
+		}
+		return stateManager.UpdateState(jobId, "Scheduled on cluster "+clusterName, statemanager.StatusPending)
+	}()
+	if err != nil {
+		clusters.Release(clusterName)
+		return err
+	}
+
+	// The watcher outlives the request that submitted the build, it gives the
+	// cluster slot back once the build is over
+	go func() {
+		err := watchWorkflow(ctx, clusters, stateManager, jobId, deployType)
+		clusters.Release(clusterName)
+		done(err)
+	}()
+	return nil
+}
@@ -1,8 +1,14 @@
 package workflows
 
 import (
+	"build-machine/internal"
+	"build-machine/service"
 	statemanager "build-machine/state_manager"
+	"context"
 	"encoding/json"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/rand"
 )
 
 type WorkflowReport struct {
@@ -14,10 +20,20 @@ type WorkflowReport struct {
 }
 
 type Workflow interface {
-	Submit() (string, error)
+	// Prepare runs once the deploy is accepted, before the build is queued
+	Prepare(ctx context.Context, jobId string) error
+	// Submit starts the build on a cluster when it leaves the queue, done
+	// is called once the build is over, with the error that stopped its
+	// status from being tracked if any
+	Submit(ctx context.Context, jobId string, done func(err error)) error
 	GetState() (WorkflowReport, error)
-	Validate(args json.RawMessage) error
+	Validate(ctx context.Context, args json.RawMessage) error
 	AssignStateManager(state statemanager.StateManager)
+	// AssignResources sets the limits of the build, it must be called before Submit
+	AssignResources(resources BuildResources)
+	// Project returns the project stage the build deploys, once validated. The
+	// account is left to the caller, which knows the user of the token
+	Project() statemanager.ProjectStage
 }
 
 var AvailableDeployments = []string{
@@ -25,32 +41,56 @@ var AvailableDeployments = []string{
 	"s3",
 }
 
-// Specific input definitions for each workflow type
-type GitDeployment struct {
-	Repository   string   `json:"githubRepository"`
-	ProjectName  string   `json:"projectName"`
-	Region       string   `json:"region"`
-	Stage        string   `json:"stage"`
-	BasePath     *string  `json:"basePath,omitempty"`
-	Stack        []string `json:"stack,omitempty"`
-	IsNewProject bool     `json:"isNewProject"`
+// argoTemplate returns the entrypoint, the WorkflowTemplate name and the
+// generated name prefix used for deployType in the current environment.
+func argoTemplate(deployType string) (templateName, templateRef, generateName string) {
+	templateName = "build-" + deployType
+	templateRef = "genezio-build-" + deployType + "-template"
+	generateName = "genezio-build-" + deployType + "-"
+	if internal.GetConfig().Env == "dev" || internal.GetConfig().Env == "local" {
+		templateName += "-dev"
+		templateRef += "-dev"
+		generateName = "genezio-build-" + deployType + "-dev-"
+	}
+	return templateName, templateRef, generateName
+}
+
+// templateRef points a build step at the template templateName of the
+// WorkflowTemplate templateRef. Builds in tenant namespaces use cluster scoped
+// templates, see (*service.ArgoService).CheckWorkflowTemplates.
+func templateRef(templateRef, templateName string) *wfv1.TemplateRef {
+	return &wfv1.TemplateRef{
+		Name:         templateRef,
+		Template:     templateName,
+		ClusterScope: internal.GetConfig().Namespaces.PerTenant,
+	}
+}
+
+// NewJobID returns a unique id for a build of deployType, it is also the name
+// of its workflow.
+func NewJobID(deployType string) string {
+	_, _, generateName := argoTemplate(deployType)
+	return generateName + rand.String(5)
 }
 
-type S3Deployment struct {
-	S3DownloadURL string            `json:"s3DownloadURL,omitempty"`
-	ProjectName   string            `json:"projectName"`
-	Stage         string            `json:"stage"`
-	Region        string            `json:"region"`
-	BasePath      *string           `json:"basePath,omitempty"`
-	Code          map[string]string `json:"code"`
+// WorkflowTemplates returns the WorkflowTemplates the builds depend on.
+func WorkflowTemplates() []string {
+	var templates []string
+	for _, deployType := range AvailableDeployments {
+		_, templateRef, _ := argoTemplate(deployType)
+		templates = append(templates, templateRef)
+	}
+	return templates
 }
 
-func GetWorkflowExecutor(workflow, token string) Workflow {
+// GetWorkflowExecutor returns the executor of a deploy type, builds are
+// submitted to the clusters of the registry.
+func GetWorkflowExecutor(workflow, token string, clusters *service.ClusterRegistry) Workflow {
 	switch workflow {
 	case "git":
-		return NewGitArgoWorkflow(token)
+		return NewGitArgoWorkflow(token, clusters)
 	case "s3":
-		return NewS3ArgoDeployment(token)
+		return NewS3ArgoDeployment(token, clusters)
 	default:
 		return nil
 	}